@@ -4,69 +4,48 @@ import (
 	"encoding/json"
 
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
-	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/wongnai/xds/snapshot"
 	"google.golang.org/protobuf/encoding/protojson"
 )
 
-type cacheMarshaler struct {
-	cache.Cache
-}
+type groupsMarshaler map[string]map[resource.Type]snapshot.PublishedResources
 
-func (c cacheMarshaler) MarshalJSON() ([]byte, error) {
-	snapshotCache, ok := c.Cache.(cache.SnapshotCache)
-	if !ok {
-		return nil, nil
-	}
+func (g groupsMarshaler) MarshalJSON() ([]byte, error) {
+	out := map[string]map[resource.Type]resourcesMarshaler{}
 
-	out := map[string]map[resource.Type]interface{}{}
-	nodes := []string{""} // TODO: how do i not hardcode this...
+	for group, resourcesByType := range g {
+		groupMap := map[resource.Type]resourcesMarshaler{}
+		out[group] = groupMap
 
-	for _, node := range nodes {
-		snapshot, err := snapshotCache.GetSnapshot(node)
-		if err != nil {
-			return nil, err
-		}
-		nodeMap := map[resource.Type]interface{}{}
-		out[node] = nodeMap
-
-		for i := types.ResponseType(0); i < types.UnknownType; i++ {
-			typeURL, _ := cache.GetResponseTypeURL(i)
-			version := snapshot.GetVersion(typeURL)
-			resources := snapshot.GetResources(typeURL)
-
-			if len(resources) == 0 {
-				continue
-			}
-
-			nodeMap[typeURL] = resourcesMarshaler{
-				version:   version,
-				resources: resources,
-			}
+		for typeURL, resources := range resourcesByType {
+			groupMap[typeURL] = resourcesMarshaler(resources)
 		}
 	}
 
 	return json.Marshal(out)
 }
 
-type resourcesMarshaler struct {
-	version   string
-	resources map[string]types.Resource
-}
+type resourcesMarshaler snapshot.PublishedResources
 
 func (r resourcesMarshaler) MarshalJSON() ([]byte, error) {
+	type item struct {
+		Version  string            `json:"version"`
+		Resource resourceMarshaler `json:"resource"`
+	}
 	type outMap struct {
-		Version string                       `json:"version"`
-		Items   map[string]resourceMarshaler `json:"items"`
+		Items map[string]item `json:"items"`
 	}
 
 	out := outMap{
-		Version: r.version,
-		Items:   map[string]resourceMarshaler{},
+		Items: map[string]item{},
 	}
 
-	for k, v := range r.resources {
-		out.Items[k] = resourceMarshaler{Resource: v}
+	for k, v := range r.Resources {
+		out.Items[k] = item{
+			Version:  r.Versions[k],
+			Resource: resourceMarshaler{Resource: v},
+		}
 	}
 
 	return json.Marshal(out)
@@ -5,19 +5,19 @@ import (
 	"net/http/pprof"
 	"time"
 
-	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	channelz "github.com/rantav/go-grpc-channelz"
+	"github.com/wongnai/xds/snapshot"
 	"k8s.io/apimachinery/pkg/util/json"
 )
 
 type Server struct {
 	http.Server
-	mux   *http.ServeMux
-	cache *cache.MuxCache
+	mux         *http.ServeMux
+	snapshotter *snapshot.Snapshotter
 }
 
-func New(cache *cache.MuxCache) *Server {
+func New(snapshotter *snapshot.Snapshotter) *Server {
 	mux := http.NewServeMux()
 	out := &Server{
 		mux: mux,
@@ -29,7 +29,7 @@ func New(cache *cache.MuxCache) *Server {
 			WriteTimeout:      60 * time.Minute, // for pprof
 			IdleTimeout:       10 * time.Second,
 		},
-		cache: cache,
+		snapshotter: snapshotter,
 	}
 	out.register()
 	return out
@@ -56,9 +56,9 @@ func (s *Server) snapshot(w http.ResponseWriter, r *http.Request) {
 	encoder := json.NewEncoder(w)
 	encoder.SetIndent("", "\t")
 
-	out := map[string]cacheMarshaler{}
-	for k, v := range s.cache.Caches {
-		out[k] = cacheMarshaler{Cache: v}
+	out := map[string]interface{}{
+		"scope":  s.snapshotter.Scope(),
+		"groups": groupsMarshaler(s.snapshotter.PublishedResources()),
 	}
 
 	encoder.Encode(out)
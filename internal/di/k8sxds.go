@@ -22,9 +22,11 @@ var K8sXdsSet = wire.NewSet(
 	ProvideLRSServer,
 )
 
-func ProvideSnapshotter(ctx context.Context, k8sClient kubernetes.Interface) (*snapshot.Snapshotter, func()) {
+type SnapshotterOptions = []snapshot.Option
+
+func ProvideSnapshotter(ctx context.Context, k8sClient kubernetes.Interface, opts SnapshotterOptions) (*snapshot.Snapshotter, func()) {
 	stopCtx, stop := context.WithCancel(ctx)
-	snapshotter := snapshot.New(k8sClient)
+	snapshotter := snapshot.New(k8sClient, opts...)
 
 	go func() {
 		err := snapshotter.Start(stopCtx)
@@ -39,7 +41,7 @@ func ProvideSnapshotter(ctx context.Context, k8sClient kubernetes.Interface) (*s
 func ProvideXdsServer(ctx context.Context, snapshotter *snapshot.Snapshotter, logger server.CallbackFuncs) (server.Server, func()) {
 	stopCtx, stop := context.WithCancel(ctx)
 
-	return server.NewServer(stopCtx, snapshotter.MuxCache(), logger), stop
+	return server.NewServer(stopCtx, snapshotter.Cache(), logger), stop
 }
 
 func ProvideXdsLogger() server.CallbackFuncs {
@@ -48,7 +50,7 @@ func ProvideXdsLogger() server.CallbackFuncs {
 
 // ProvideDebugServer create a debug server and immediately starts it
 func ProvideDebugServer(snapshotter *snapshot.Snapshotter) *debug.Server {
-	server := debug.New(snapshotter.MuxCache())
+	server := debug.New(snapshotter)
 
 	go server.ListenAndServe()
 
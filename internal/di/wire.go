@@ -25,7 +25,7 @@ type DevServer struct {
 	GrpcServer *grpc.Server
 }
 
-func InitializeServer(ctx context.Context, statsIntervalSeconds StatsIntervalSeconds) (Servers, func(), error) {
+func InitializeServer(ctx context.Context, statsIntervalSeconds StatsIntervalSeconds, snapshotterOptions SnapshotterOptions) (Servers, func(), error) {
 	wire.Build(
 		KubernetesSet,
 		GrpcSet,
@@ -38,7 +38,7 @@ func InitializeServer(ctx context.Context, statsIntervalSeconds StatsIntervalSec
 	return Servers{}, nil, nil
 }
 
-func InitializeTestServer(ctx context.Context, kubeClient kubernetes.Interface, statsIntervalSeconds StatsIntervalSeconds) (TestServer, func(), error) {
+func InitializeTestServer(ctx context.Context, kubeClient kubernetes.Interface, statsIntervalSeconds StatsIntervalSeconds, snapshotterOptions SnapshotterOptions) (TestServer, func(), error) {
 	wire.Build(
 		GrpcSet,
 		K8sXdsSet,
@@ -15,7 +15,7 @@ import (
 
 // Injectors from wire.go:
 
-func InitializeServer(ctx context.Context, statsIntervalSeconds StatsIntervalSeconds) (Servers, func(), error) {
+func InitializeServer(ctx context.Context, statsIntervalSeconds StatsIntervalSeconds, snapshotterOptions SnapshotterOptions) (Servers, func(), error) {
 	v := ProvideOtelGrpcServerOptions()
 	server, cleanup := ProvideGrpcServer(v)
 	config, err := ProvideClientConfig()
@@ -34,7 +34,7 @@ func InitializeServer(ctx context.Context, statsIntervalSeconds StatsIntervalSec
 		cleanup()
 		return Servers{}, nil, err
 	}
-	snapshotter, cleanup2 := ProvideSnapshotter(ctx, kubernetesInterface)
+	snapshotter, cleanup2 := ProvideSnapshotter(ctx, kubernetesInterface, snapshotterOptions)
 	callbackFuncs := ProvideXdsLogger()
 	serverServer, cleanup3 := ProvideXdsServer(ctx, snapshotter, callbackFuncs)
 	sideEffectADSRegistered := ProvideSideEffectADSRegistered(server, serverServer)
@@ -76,10 +76,10 @@ func InitializeServer(ctx context.Context, statsIntervalSeconds StatsIntervalSec
 	}, nil
 }
 
-func InitializeTestServer(ctx context.Context, kubeClient kubernetes.Interface, statsIntervalSeconds StatsIntervalSeconds) (TestServer, func(), error) {
+func InitializeTestServer(ctx context.Context, kubeClient kubernetes.Interface, statsIntervalSeconds StatsIntervalSeconds, snapshotterOptions SnapshotterOptions) (TestServer, func(), error) {
 	v := ProvideGrpcTestOption()
 	server, cleanup := ProvideGrpcServer(v)
-	snapshotter, cleanup2 := ProvideSnapshotter(ctx, kubeClient)
+	snapshotter, cleanup2 := ProvideSnapshotter(ctx, kubeClient, snapshotterOptions)
 	callbackFuncs := ProvideXdsLogger()
 	serverServer, cleanup3 := ProvideXdsServer(ctx, snapshotter, callbackFuncs)
 	sideEffectADSRegistered := ProvideSideEffectADSRegistered(server, serverServer)
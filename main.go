@@ -6,10 +6,12 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/wongnai/xds/internal/di"
 	"github.com/wongnai/xds/meter"
+	"github.com/wongnai/xds/snapshot"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/oidc"
 	"k8s.io/klog/v2"
 )
@@ -18,12 +20,39 @@ func main() {
 	klog.InitFlags(nil)
 
 	var statsIntervalInSeconds int64
+	var legacyEndpoints bool
+	var nodeTopology bool
+	var namespaces, excludeNamespaces string
+	var scope snapshot.Scope
+	var mtls snapshot.MTLS
+	var mtlsNamespaces string
 	flag.CommandLine.Int64Var(&statsIntervalInSeconds, "statsinterval", 300, "stats update interval in seconds")
+	flag.CommandLine.BoolVar(&legacyEndpoints, "legacyendpoints", false, "source endpoints from core/v1 Endpoints instead of EndpointSlices")
+	flag.CommandLine.BoolVar(&nodeTopology, "nodetopology", true, "watch nodes' topology labels to build endpoint localities")
+	flag.CommandLine.StringVar(&namespaces, "namespaces", "", "comma-separated list of namespaces to watch, default to all namespaces")
+	flag.CommandLine.StringVar(&excludeNamespaces, "excludenamespaces", "", "comma-separated list of namespaces to not watch")
+	flag.CommandLine.StringVar(&scope.LabelSelector, "labelselector", "", "label selector of watched services and endpoints")
+	flag.CommandLine.StringVar(&scope.FieldSelector, "fieldselector", "", "field selector of watched services. Not applied to endpoints, which do not share the fields of services")
+	flag.CommandLine.StringVar(&mtlsNamespaces, "mtlsnamespaces", "", "comma-separated list of namespaces where services use mTLS unless disabled by annotation")
+	flag.CommandLine.StringVar(&mtls.TrustDomain, "mtlstrustdomain", "cluster.local", "SPIFFE trust domain of service accounts")
+	flag.CommandLine.StringVar(&mtls.CertificateProvider, "mtlscertificateprovider", "default", "certificate provider instance name in the clients' xDS bootstrap")
 	flag.Parse()
 
+	scope.Namespaces = splitList(namespaces)
+	scope.ExcludeNamespaces = splitList(excludeNamespaces)
+	mtls.Namespaces = splitList(mtlsNamespaces)
+	if err := scope.Validate(); err != nil {
+		klog.Fatal(err)
+	}
+
 	meter.InstallPromExporter()
 
-	servers, stop, err := di.InitializeServer(context.Background(), statsIntervalInSeconds)
+	servers, stop, err := di.InitializeServer(context.Background(), statsIntervalInSeconds, di.SnapshotterOptions{
+		snapshot.WithLegacyEndpoints(legacyEndpoints),
+		snapshot.WithNodeTopology(nodeTopology),
+		snapshot.WithScope(scope),
+		snapshot.WithMTLS(mtls),
+	})
 	if err != nil {
 		klog.Fatal(err)
 	}
@@ -49,3 +78,15 @@ func main() {
 	lis.Close()
 	klog.Infoln("Gracefully stopped")
 }
+
+// splitList split comma-separated flag value, ignoring empty items
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -12,9 +12,13 @@ import (
 )
 
 var (
-	TypeURLAttrKey    attribute.Key = "type_url"
-	APIGatewayAttrKey attribute.Key = "api_gateway"
-	ResourceAttrKey   attribute.Key = "resource"
+	TypeURLAttrKey                attribute.Key = "type_url"
+	APIGatewayAttrKey             attribute.Key = "api_gateway"
+	ResourceAttrKey               attribute.Key = "resource"
+	ScopeNamespacesAttrKey        attribute.Key = "namespaces"
+	ScopeExcludeNamespacesAttrKey attribute.Key = "exclude_namespaces"
+	ScopeLabelSelectorAttrKey     attribute.Key = "label_selector"
+	ScopeFieldSelectorAttrKey     attribute.Key = "field_selector"
 )
 
 func NewXdsServerCallbackFuncs() server.CallbackFuncs {
@@ -0,0 +1,115 @@
+package snapshot
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/ccoveille/go-safecast"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// AnnotationAddressMode is the addresses published as the service's endpoints. It is one of the AddressMode values
+const AnnotationAddressMode = "xds.lmwn.com/address-mode"
+
+const (
+	// AddressModePod publish the IPs of the service's pods. This is the default
+	AddressModePod = "pod"
+	// AddressModeClusterIP publish the service's ClusterIP
+	AddressModeClusterIP = "cluster-ip"
+	// AddressModeLoadBalancer publish the IPs of the service's load balancer ingress
+	AddressModeLoadBalancer = "load-balancer"
+)
+
+// serviceAddressesToResources convert the services that do not use pod addresses to Endpoint
+// of their ClusterIP or load balancer ingress, keyed by the service's namespace/name
+func serviceAddressesToResources(services []*corev1.Service) map[string][]types.Resource {
+	out := map[string][]types.Resource{}
+	for _, svc := range services {
+		addressMode, ok := svc.GetAnnotations()[AnnotationAddressMode]
+		if !ok {
+			continue
+		}
+
+		ips, err := serviceAddresses(svc, addressMode)
+		if err != nil {
+			klog.ErrorS(err, "invalid address-mode", "object", klog.KObj(svc), "address-mode", addressMode)
+			continue
+		}
+		if ips == nil {
+			continue
+		}
+
+		resources := make([]types.Resource, 0, len(svc.Spec.Ports))
+		for _, port := range svc.Spec.Ports {
+			resources = append(resources, addressesToClusterLoadAssignment(
+				fmt.Sprintf("%s.%s:%s", svc.Name, svc.Namespace, port.Name),
+				ips,
+				port.Port,
+			))
+		}
+		out[svc.Namespace+"/"+svc.Name] = resources
+	}
+	return out
+}
+
+// serviceAddresses return the IPs of the service in the address mode. It returns nil if the service uses pod addresses.
+// Services without load balancer ingress yet have no addresses
+func serviceAddresses(service *corev1.Service, addressMode string) ([]string, error) {
+	switch addressMode {
+	case AddressModePod:
+		return nil, nil
+	case AddressModeClusterIP:
+		if net.ParseIP(service.Spec.ClusterIP) == nil {
+			return nil, fmt.Errorf("service has no ClusterIP")
+		}
+		return []string{service.Spec.ClusterIP}, nil
+	case AddressModeLoadBalancer:
+		if service.Spec.Type != corev1.ServiceTypeLoadBalancer {
+			return nil, fmt.Errorf("service is not a LoadBalancer")
+		}
+		out := []string{}
+		for _, ingress := range service.Status.LoadBalancer.Ingress {
+			// gRPC only connect to IPs from EDS
+			if ingress.IP != "" {
+				out = append(out, ingress.IP)
+			}
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unknown address mode %q", addressMode)
+	}
+}
+
+// addressesToClusterLoadAssignment build a ClusterLoadAssignment of healthy endpoints of the IPs in a single locality
+func addressesToClusterLoadAssignment(clusterName string, ips []string, port int32) *endpointv3.ClusterLoadAssignment {
+	out := &endpointv3.ClusterLoadAssignment{
+		ClusterName: clusterName,
+	}
+	if len(ips) == 0 {
+		return out
+	}
+
+	localityEndpoints := &endpointv3.LocalityLbEndpoints{
+		Locality: &corev3.Locality{},
+	}
+	for _, ip := range ips {
+		localityEndpoints.LbEndpoints = append(localityEndpoints.LbEndpoints, addressToLbEndpoint(endpointAddress{
+			IP:           ip,
+			Port:         port,
+			HealthStatus: corev3.HealthStatus_HEALTHY,
+		}))
+	}
+	weight, err := safecast.ToUint32(len(ips))
+	if err != nil {
+		panic(err)
+	}
+	localityEndpoints.LoadBalancingWeight = wrapperspb.UInt32(weight)
+	out.Endpoints = append(out.Endpoints, localityEndpoints)
+
+	return out
+}
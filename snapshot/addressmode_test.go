@@ -0,0 +1,111 @@
+package snapshot
+
+import (
+	"testing"
+
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_serviceAddresses(t *testing.T) {
+	for _, testcase := range []struct {
+		Name        string
+		AddressMode string
+		Spec        corev1.ServiceSpec
+		Ingress     []corev1.LoadBalancerIngress
+		Expect      []string
+		ExpectErr   bool
+	}{
+		{
+			Name:        "pod",
+			AddressMode: AddressModePod,
+			Spec:        corev1.ServiceSpec{ClusterIP: "10.96.0.10"},
+		},
+		{
+			Name:        "cluster-ip",
+			AddressMode: AddressModeClusterIP,
+			Spec:        corev1.ServiceSpec{ClusterIP: "10.96.0.10"},
+			Expect:      []string{"10.96.0.10"},
+		},
+		{
+			Name:        "headless",
+			AddressMode: AddressModeClusterIP,
+			Spec:        corev1.ServiceSpec{ClusterIP: corev1.ClusterIPNone},
+			ExpectErr:   true,
+		},
+		{
+			Name:        "load-balancer",
+			AddressMode: AddressModeLoadBalancer,
+			Spec:        corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+			Ingress:     []corev1.LoadBalancerIngress{{IP: "203.0.113.1"}, {Hostname: "lb.example.com"}, {IP: "203.0.113.2"}},
+			Expect:      []string{"203.0.113.1", "203.0.113.2"},
+		},
+		{
+			Name:        "load-balancer pending",
+			AddressMode: AddressModeLoadBalancer,
+			Spec:        corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+			Expect:      []string{},
+		},
+		{
+			Name:        "not load-balancer",
+			AddressMode: AddressModeLoadBalancer,
+			Spec:        corev1.ServiceSpec{Type: corev1.ServiceTypeClusterIP},
+			ExpectErr:   true,
+		},
+		{
+			Name:        "unknown",
+			AddressMode: "node-port",
+			ExpectErr:   true,
+		},
+	} {
+		t.Run(testcase.Name, func(t *testing.T) {
+			service := &corev1.Service{Spec: testcase.Spec}
+			service.Status.LoadBalancer.Ingress = testcase.Ingress
+			out, err := serviceAddresses(service, testcase.AddressMode)
+			if testcase.ExpectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testcase.Expect, out)
+		})
+	}
+}
+
+func Test_serviceAddressesToResources(t *testing.T) {
+	newService := func(name string, addressMode string) *corev1.Service {
+		out := newTestService(nil)
+		out.Name = name
+		out.Spec = corev1.ServiceSpec{
+			ClusterIP: "10.96.0.10",
+			Ports: []corev1.ServicePort{
+				{Name: "grpc", Port: 80},
+				{Name: "grpc-admin", Port: 81},
+			},
+		}
+		if addressMode != "" {
+			out.Annotations = map[string]string{AnnotationAddressMode: addressMode}
+		}
+		return out
+	}
+
+	out := serviceAddressesToResources([]*corev1.Service{
+		newService("default", ""),
+		newService("pod", AddressModePod),
+		newService("invalid", "invalid"),
+		newService("cluster-ip", AddressModeClusterIP),
+	})
+	require.Len(t, out, 1)
+	require.Len(t, out["default/cluster-ip"], 2)
+
+	cla := out["default/cluster-ip"][1].(*endpointv3.ClusterLoadAssignment)
+	assert.Equal(t, "cluster-ip.default:grpc-admin", cla.ClusterName)
+	require.Len(t, cla.Endpoints, 1)
+	assert.EqualValues(t, 1, cla.Endpoints[0].LoadBalancingWeight.GetValue())
+	require.Len(t, cla.Endpoints[0].LbEndpoints, 1)
+	address := cla.Endpoints[0].LbEndpoints[0].GetEndpoint().GetAddress().GetSocketAddress()
+	assert.Equal(t, "10.96.0.10", address.GetAddress())
+	assert.Equal(t, uint32(81), address.GetPortValue())
+}
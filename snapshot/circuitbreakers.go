@@ -0,0 +1,64 @@
+package snapshot
+
+import (
+	"fmt"
+	"strconv"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const AnnotationMaxRequests = "xds.lmwn.com/max-requests"
+const AnnotationMaxRequestsHighPriority = "xds.lmwn.com/max-requests-high-priority"
+
+// circuitBreakersFromService convert annotations on the Kubernetes service to xDS circuit breakers
+// It may return nil if not configured
+//
+// The supported values are as in gRPC [A32](https://github.com/grpc/proposal/blob/master/A32-xds-circuit-breaking.md).
+// gRPC only reads the default priority threshold, the high priority threshold is for other xDS clients
+func circuitBreakersFromService(service *corev1.Service) *clusterv3.CircuitBreakers {
+	annotations := service.GetAnnotations()
+	out := &clusterv3.CircuitBreakers{}
+
+	priorities := []struct {
+		annotation string
+		priority   corev3.RoutingPriority
+	}{
+		{AnnotationMaxRequests, corev3.RoutingPriority_DEFAULT},
+		{AnnotationMaxRequestsHighPriority, corev3.RoutingPriority_HIGH},
+	}
+	for _, priority := range priorities {
+		value, ok := annotations[priority.annotation]
+		if !ok {
+			continue
+		}
+		parsed, err := parseMaxRequests(value)
+		if err != nil {
+			klog.ErrorS(err, "cannot parse max requests", "object", klog.KObj(service), "annotation", priority.annotation, "value", value)
+			continue
+		}
+		out.Thresholds = append(out.Thresholds, &clusterv3.CircuitBreakers_Thresholds{
+			Priority:    priority.priority,
+			MaxRequests: wrapperspb.UInt32(parsed),
+		})
+	}
+
+	if len(out.Thresholds) == 0 {
+		return nil
+	}
+	return out
+}
+
+func parseMaxRequests(v string) (uint32, error) {
+	parsed, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	if parsed == 0 {
+		return 0, fmt.Errorf("max requests must be greater than 0")
+	}
+	return uint32(parsed), nil
+}
@@ -0,0 +1,36 @@
+package snapshot
+
+import (
+	"testing"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_circuitBreakersFromService(t *testing.T) {
+	assert.Nil(t, circuitBreakersFromService(newTestService(nil)))
+	assert.Nil(t, circuitBreakersFromService(newTestService(map[string]string{
+		AnnotationMaxRequests: "0",
+	})))
+	assert.Nil(t, circuitBreakersFromService(newTestService(map[string]string{
+		AnnotationMaxRequests: "-1",
+	})))
+
+	out := circuitBreakersFromService(newTestService(map[string]string{
+		AnnotationMaxRequests: "100",
+	}))
+	require.NotNil(t, out)
+	require.Len(t, out.Thresholds, 1)
+	assert.Equal(t, corev3.RoutingPriority_DEFAULT, out.Thresholds[0].Priority)
+	assert.Equal(t, uint32(100), out.Thresholds[0].MaxRequests.GetValue())
+
+	out = circuitBreakersFromService(newTestService(map[string]string{
+		AnnotationMaxRequests:             "invalid",
+		AnnotationMaxRequestsHighPriority: "200",
+	}))
+	require.NotNil(t, out)
+	require.Len(t, out.Thresholds, 1)
+	assert.Equal(t, corev3.RoutingPriority_HIGH, out.Thresholds[0].Priority)
+	assert.Equal(t, uint32(200), out.Thresholds[0].MaxRequests.GetValue())
+}
@@ -3,13 +3,17 @@ package snapshot
 import (
 	"context"
 	"fmt"
+	"maps"
+	"slices"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/ccoveille/go-safecast"
 	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
-	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 	"github.com/wongnai/xds/meter"
 	"go.opentelemetry.io/otel/metric"
 	"google.golang.org/protobuf/types/known/wrapperspb"
@@ -18,7 +22,6 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/watch"
 	k8scache "k8s.io/client-go/tools/cache"
-	"k8s.io/klog/v2"
 )
 
 type endpointCacheItem struct {
@@ -26,54 +29,109 @@ type endpointCacheItem struct {
 	resources []types.Resource
 }
 
+// serviceEndpoints is the list of backends of a Kubernetes service
+// normalized from either the legacy Endpoints or EndpointSlices
+type serviceEndpoints struct {
+	Name      string
+	Namespace string
+	// Version changes whenever any of the source objects changed
+	Version string
+	// Ports map port name (or port number, if unnamed) to its addresses
+	Ports map[string][]endpointAddress
+}
+
+type endpointAddress struct {
+	IP       string
+	Port     int32
+	Hostname string
+	NodeName string
+	// Zone is the zone reported by EndpointSlice. The node's zone is used if empty
+	Zone      string
+	TargetRef *corev1.ObjectReference
+	// HealthStatus is HEALTHY for ready endpoints, DRAINING for terminating endpoints and UNHEALTHY otherwise
+	HealthStatus corev3.HealthStatus
+}
+
 func (s *Snapshotter) startEndpoints(ctx context.Context) error {
 	emit := func() {}
 
-	store := k8scache.NewUndeltaStore(func(v []interface{}) {
+	reflector := s.newScopedReflector(&corev1.Endpoints{}, func(namespace string) *k8scache.ListWatch { //nolint:staticcheck // We use deprecated API to support legacy Kubernetes
+		return &k8scache.ListWatch{
+			ListWithContextFunc: func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+				return s.client.CoreV1().Endpoints(namespace).List(ctx, options)
+			},
+			WatchFuncWithContext: func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
+				return s.client.CoreV1().Endpoints(namespace).Watch(ctx, options)
+			},
+		}
+	}, func() {
 		emit()
-	}, k8scache.DeletionHandlingMetaNamespaceKeyFunc)
+	})
 
-	reflector := k8scache.NewReflector(&k8scache.ListWatch{
-		ListWithContextFunc: func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
-			return s.client.CoreV1().Endpoints("").List(ctx, options)
-		},
-		WatchFuncWithContext: func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
-			return s.client.CoreV1().Endpoints("").Watch(ctx, options)
-		},
-	}, &corev1.Endpoints{}, store, s.ResyncPeriod) //nolint:staticcheck // We use deprecated API to support legacy Kubernetes
-
-	var lastSnapshotHash uint64
+	refresh := func() {
+		endpoints := kubeEndpointsToServiceEndpoints(sliceToEndpoints(reflector.List()))
+		s.emitEndpoints(reflector.LastSyncResourceVersion(), endpoints)
+	}
 
+	var once sync.Once
 	emit = func() {
-		version := reflector.LastSyncResourceVersion()
 		s.kubeEventCounter.Add(ctx, 1, metric.WithAttributes(meter.ResourceAttrKey.String("endpoints")))
+		refresh()
+		once.Do(func() {
+			s.setEndpointsRefresher(func() {
+				reflector.Locked(refresh)
+			})
+		})
+	}
 
-		endpoints := sliceToEndpoints(store.List())
-		endpointsResources := s.kubeEndpointsToResources(endpoints)
-		hash, err := resourcesHash(endpointsResources)
-		if err == nil {
-			if hash == lastSnapshotHash {
-				klog.V(5).Info("new snapshot is equivalent to the previous one")
-				return
-			}
-			lastSnapshotHash = hash
-		} else {
-			klog.Errorf("fail to hash snapshot: %s", err)
-		}
+	reflector.Run(ctx)
+	return nil
+}
 
-		resourcesByType := resourcesToMap(endpointsResources)
-		s.setEndpointResourcesByType(resourcesByType)
+// emitEndpoints convert the endpoints to resources and publish them to the endpoints cache
+func (s *Snapshotter) emitEndpoints(version string, endpoints []*serviceEndpoints) {
+	s.endpointsLock.Lock()
+	defer s.endpointsLock.Unlock()
 
-		snapshot, err := cache.NewSnapshot(version, resourcesByType)
-		if err != nil {
-			panic(err)
+	s.setEndpointResources(version, endpoints, s.serviceEndpointsToResources(endpoints))
+}
+
+func (s *Snapshotter) setEndpointsRefresher(refresher func()) {
+	s.endpointsLock.Lock()
+	defer s.endpointsLock.Unlock()
+	s.endpointsRefresher = refresher
+}
+
+// setHeadlessServices replace the headless services, keyed by namespace/name, and return whether they have changed.
+// Endpoints of headless services also build the resources of their pods
+func (s *Snapshotter) setHeadlessServices(services []*corev1.Service) bool {
+	headless := map[string]struct{}{}
+	for _, svc := range services {
+		if svc.Spec.ClusterIP == corev1.ClusterIPNone {
+			headless[svc.Namespace+"/"+svc.Name] = struct{}{}
 		}
+	}
 
-		s.endpointsCache.SetSnapshot(ctx, "", snapshot)
+	s.endpointsLock.Lock()
+	defer s.endpointsLock.Unlock()
+	if maps.Equal(s.headlessServices, headless) {
+		return false
 	}
+	s.headlessServices = headless
+	return true
+}
 
-	reflector.Run(ctx.Done())
-	return nil
+// refreshEndpoints rebuild all endpoint resources from the latest known endpoints
+// It does nothing if the endpoints have not been synced yet
+func (s *Snapshotter) refreshEndpoints() {
+	s.endpointsLock.Lock()
+	refresher := s.endpointsRefresher
+	s.endpointResourceCache = map[string]endpointCacheItem{}
+	s.endpointsLock.Unlock()
+
+	if refresher != nil {
+		refresher()
+	}
 }
 
 func sliceToEndpoints(s []interface{}) []*corev1.Endpoints { //nolint:staticcheck // We use deprecated API to support legacy Kubernetes
@@ -84,96 +142,262 @@ func sliceToEndpoints(s []interface{}) []*corev1.Endpoints { //nolint:staticchec
 	return out
 }
 
-// kubeServicesToResources convert list of Kubernetes endpoints to Endpoint
-func (s *Snapshotter) kubeEndpointsToResources(endpoints []*corev1.Endpoints) []types.Resource { //nolint:staticcheck // We use deprecated API to support legacy Kubernetes
-	var out []types.Resource
+// kubeEndpointsToServiceEndpoints convert list of legacy Kubernetes endpoints to serviceEndpoints
+func kubeEndpointsToServiceEndpoints(endpoints []*corev1.Endpoints) []*serviceEndpoints { //nolint:staticcheck // We use deprecated API to support legacy Kubernetes
+	out := make([]*serviceEndpoints, 0, len(endpoints))
 
 	for _, ep := range endpoints {
-		out = append(out, s.kubeEndpointToResources(ep)...)
+		svcEndpoints := &serviceEndpoints{
+			Name:      ep.Name,
+			Namespace: ep.Namespace,
+			Version:   ep.ResourceVersion,
+			Ports:     map[string][]endpointAddress{},
+		}
+
+		for _, subset := range ep.Subsets {
+			for _, port := range subset.Ports {
+				portName := port.Name
+				if portName == "" {
+					portName = strconv.Itoa(int(port.Port))
+				}
+
+				addresses := svcEndpoints.Ports[portName]
+				addresses = appendEndpointAddresses(addresses, subset.Addresses, port.Port, corev3.HealthStatus_HEALTHY)
+				addresses = appendEndpointAddresses(addresses, subset.NotReadyAddresses, port.Port, corev3.HealthStatus_UNHEALTHY)
+				svcEndpoints.Ports[portName] = addresses
+			}
+		}
+
+		out = append(out, svcEndpoints)
 	}
 
 	return out
 }
 
-func (s *Snapshotter) kubeEndpointToResources(ep *corev1.Endpoints) []types.Resource { //nolint:staticcheck // We use deprecated API to support legacy Kubernetes
-	name, err := k8scache.MetaNamespaceKeyFunc(ep)
-	if err != nil {
-		klog.Errorf("fail to get object key: %s", err)
-		return nil
+func appendEndpointAddresses(out []endpointAddress, addresses []corev1.EndpointAddress, port int32, healthStatus corev3.HealthStatus) []endpointAddress { //nolint:staticcheck // We use deprecated API to support legacy Kubernetes
+	for _, addr := range addresses {
+		nodeName := ""
+		if addr.NodeName != nil {
+			nodeName = *addr.NodeName
+		}
+		out = append(out, endpointAddress{
+			IP:           addr.IP,
+			Port:         port,
+			Hostname:     addr.Hostname,
+			NodeName:     nodeName,
+			TargetRef:    addr.TargetRef,
+			HealthStatus: healthStatus,
+		})
 	}
-	if val, ok := s.endpointResourceCache[name]; ok && val.version == ep.ResourceVersion {
+	return out
+}
+
+// serviceEndpointsToResources convert list of service endpoints to Endpoint, keyed by the service's namespace/name
+func (s *Snapshotter) serviceEndpointsToResources(endpoints []*serviceEndpoints) map[string][]types.Resource {
+	out := make(map[string][]types.Resource, len(endpoints))
+
+	resourceCache := make(map[string]endpointCacheItem, len(endpoints))
+	for _, ep := range endpoints {
+		out[ep.Namespace+"/"+ep.Name] = s.serviceEndpointToResources(ep, resourceCache)
+	}
+	// Replace the cache so removed services do not stay in memory
+	s.endpointResourceCache = resourceCache
+
+	return out
+}
+
+func (s *Snapshotter) serviceEndpointToResources(ep *serviceEndpoints, resourceCache map[string]endpointCacheItem) []types.Resource {
+	name := ep.Namespace + "/" + ep.Name
+	if val, ok := s.endpointResourceCache[name]; ok && val.version == ep.Version {
+		resourceCache[name] = val
 		return val.resources
 	}
 
 	var out []types.Resource
 
-	for _, subset := range ep.Subsets {
-		for _, port := range subset.Ports {
-			var portName string
-			if port.Name == "" {
-				portName = fmt.Sprintf("%s.%s:%d", ep.Name, ep.Namespace, port.Port)
-			} else {
-				portName = fmt.Sprintf("%s.%s:%s", ep.Name, ep.Namespace, port.Name)
+	portNames := make([]string, 0, len(ep.Ports))
+	for portName := range ep.Ports {
+		portNames = append(portNames, portName)
+	}
+	sort.Strings(portNames)
+
+	for _, portName := range portNames {
+		addresses := ep.Ports[portName]
+		out = append(out, s.endpointAddressesToClusterLoadAssignment(fmt.Sprintf("%s.%s:%s", ep.Name, ep.Namespace, portName), addresses))
+
+		// Pods with hostname of headless services, such as StatefulSet pods, also have a cluster of their own
+		if _, ok := s.headlessServices[name]; !ok {
+			continue
+		}
+		byHostname := map[string][]endpointAddress{}
+		for _, addr := range addresses {
+			if addr.Hostname != "" {
+				byHostname[addr.Hostname] = append(byHostname[addr.Hostname], addr)
 			}
+		}
+		for _, hostname := range slices.Sorted(maps.Keys(byHostname)) {
+			out = append(out, s.endpointAddressesToClusterLoadAssignment(fmt.Sprintf("%s.%s.%s:%s", hostname, ep.Name, ep.Namespace, portName), byHostname[hostname]))
+		}
+	}
 
-			cla := &endpointv3.ClusterLoadAssignment{
-				ClusterName: portName,
-				Endpoints: []*endpointv3.LocalityLbEndpoints{
-					{
-						LoadBalancingWeight: wrapperspb.UInt32(1),
-						Locality:            &corev3.Locality{},
-						LbEndpoints:         []*endpointv3.LbEndpoint{},
-					},
-				},
+	resourceCache[name] = endpointCacheItem{
+		version:   ep.Version,
+		resources: out,
+	}
+
+	return out
+}
+
+// healthStatusPrecedence rank the statuses of an address or pod that is listed more than once.
+// Draining wins as the pod is terminating. Otherwise the healthier status wins, as the slices
+// of each IP family, or of a slice being rebalanced, may be updated at different times
+func healthStatusPrecedence(status corev3.HealthStatus) int {
+	switch status {
+	case corev3.HealthStatus_DRAINING:
+		return 3
+	case corev3.HealthStatus_HEALTHY:
+		return 2
+	case corev3.HealthStatus_UNHEALTHY:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// endpointAddressesToClusterLoadAssignment build a ClusterLoadAssignment of the addresses grouped by locality
+func (s *Snapshotter) endpointAddressesToClusterLoadAssignment(clusterName string, addresses []endpointAddress) *endpointv3.ClusterLoadAssignment {
+	cla := &endpointv3.ClusterLoadAssignment{
+		ClusterName: clusterName,
+	}
+
+	sort.SliceStable(addresses, func(i, j int) bool {
+		l := addresses[i]
+		r := addresses[j]
+		if l.IP != r.IP {
+			// IPv4 addresses come first, so that they are the primary address of dual-stack pods
+			if lIPv6, rIPv6 := strings.Contains(l.IP, ":"), strings.Contains(r.IP, ":"); lIPv6 != rIPv6 {
+				return rIPv6
 			}
-			out = append(out, cla)
+			return l.IP < r.IP
+		}
+		if l.Port != r.Port {
+			return l.Port < r.Port
+		}
+		// The status of the highest precedence is used when the same address is listed twice
+		return healthStatusPrecedence(l.HealthStatus) > healthStatusPrecedence(r.HealthStatus)
+	})
+
+	localities := map[locality]*endpointv3.LocalityLbEndpoints{}
+	podEndpoints := map[string]*endpointv3.LbEndpoint{}
+	for i, addr := range addresses {
+		// The same address may be listed in multiple EndpointSlices while the slices are being rebalanced
+		if i > 0 && addresses[i-1].IP == addr.IP && addresses[i-1].Port == addr.Port {
+			continue
+		}
 
-			sortedAddresses := subset.Addresses
-			sort.SliceStable(sortedAddresses, func(i, j int) bool {
-				l := sortedAddresses[i].IP
-				r := sortedAddresses[j].IP
-				return l < r
+		// Pods with multiple IPs, such as on dual-stack clusters, are listed once with the other IPs as additional addresses
+		// as in gRPC [A61](https://github.com/grpc/proposal/blob/master/A61-IPv4-IPv6-dualstack-backends.md),
+		// so that they do not get a larger share of traffic
+		podKey := ""
+		if addr.TargetRef != nil && addr.TargetRef.Name != "" {
+			podKey = fmt.Sprintf("%s/%s/%s:%d", addr.TargetRef.Kind, addr.TargetRef.Namespace, addr.TargetRef.Name, addr.Port)
+		}
+		if lbEndpoint, ok := podEndpoints[podKey]; ok {
+			endpoint := lbEndpoint.GetEndpoint()
+			endpoint.AdditionalAddresses = append(endpoint.AdditionalAddresses, &endpointv3.Endpoint_AdditionalAddress{
+				Address: addressToSocketAddress(addr),
 			})
+			if healthStatusPrecedence(addr.HealthStatus) > healthStatusPrecedence(lbEndpoint.HealthStatus) {
+				lbEndpoint.HealthStatus = addr.HealthStatus
+			}
+			continue
+		}
 
-			for _, addr := range sortedAddresses {
-				hostname := addr.Hostname
-				if hostname == "" && addr.TargetRef != nil {
-					hostname = fmt.Sprintf("%s.%s", addr.TargetRef.Name, addr.TargetRef.Namespace)
-				}
-				if hostname == "" && addr.NodeName != nil {
-					hostname = *addr.NodeName
-				}
-				portU32, err := safecast.ToUint32(port.Port)
-				if err != nil {
-					panic(err)
-				}
+		addrLocality := s.endpointLocality(addr)
+		localityEndpoints, ok := localities[addrLocality]
+		if !ok {
+			localityEndpoints = &endpointv3.LocalityLbEndpoints{
+				Locality: &corev3.Locality{
+					Region:  addrLocality.Region,
+					Zone:    addrLocality.Zone,
+					SubZone: addrLocality.SubZone,
+				},
+			}
+			localities[addrLocality] = localityEndpoints
+			cla.Endpoints = append(cla.Endpoints, localityEndpoints)
+		}
+		lbEndpoint := addressToLbEndpoint(addr)
+		if podKey != "" {
+			podEndpoints[podKey] = lbEndpoint
+		}
+		localityEndpoints.LbEndpoints = append(localityEndpoints.LbEndpoints, lbEndpoint)
+	}
 
-				cla.Endpoints[0].LbEndpoints = append(cla.Endpoints[0].LbEndpoints, &endpointv3.LbEndpoint{
-					HostIdentifier: &endpointv3.LbEndpoint_Endpoint{
-						Endpoint: &endpointv3.Endpoint{
-							Address: &corev3.Address{
-								Address: &corev3.Address_SocketAddress{
-									SocketAddress: &corev3.SocketAddress{
-										Protocol: corev3.SocketAddress_TCP,
-										Address:  addr.IP,
-										PortSpecifier: &corev3.SocketAddress_PortValue{
-											PortValue: portU32,
-										},
-									},
-								},
-							},
-							Hostname: hostname,
-						},
-					},
-				})
+	// Locality weights follow the number of healthy endpoints, so every endpoint gets an equal share of traffic.
+	// gRPC ignores localities with zero weight, so the weight is at least 1 to keep unhealthy and draining endpoints visible
+	for _, localityEndpoints := range cla.Endpoints {
+		healthy := 0
+		for _, lbEndpoint := range localityEndpoints.LbEndpoints {
+			if lbEndpoint.HealthStatus == corev3.HealthStatus_HEALTHY {
+				healthy++
 			}
 		}
+		weight, err := safecast.ToUint32(max(healthy, 1))
+		if err != nil {
+			panic(err)
+		}
+		localityEndpoints.LoadBalancingWeight = wrapperspb.UInt32(weight)
 	}
+	sort.SliceStable(cla.Endpoints, func(i, j int) bool {
+		l := cla.Endpoints[i].Locality
+		r := cla.Endpoints[j].Locality
+		if l.Region != r.Region {
+			return l.Region < r.Region
+		}
+		if l.Zone != r.Zone {
+			return l.Zone < r.Zone
+		}
+		return l.SubZone < r.SubZone
+	})
 
-	s.endpointResourceCache[name] = endpointCacheItem{
-		version:   ep.ResourceVersion,
-		resources: out,
+	return cla
+}
+
+func addressToLbEndpoint(addr endpointAddress) *endpointv3.LbEndpoint {
+	hostname := addr.Hostname
+	if hostname == "" && addr.TargetRef != nil {
+		hostname = fmt.Sprintf("%s.%s", addr.TargetRef.Name, addr.TargetRef.Namespace)
+	}
+	if hostname == "" {
+		hostname = addr.NodeName
 	}
 
-	return out
+	return &endpointv3.LbEndpoint{
+		HostIdentifier: &endpointv3.LbEndpoint_Endpoint{
+			Endpoint: &endpointv3.Endpoint{
+				Address:  addressToSocketAddress(addr),
+				Hostname: hostname,
+			},
+		},
+		HealthStatus: addr.HealthStatus,
+	}
+}
+
+func addressToSocketAddress(addr endpointAddress) *corev3.Address {
+	portU32, err := safecast.ToUint32(addr.Port)
+	if err != nil {
+		panic(err)
+	}
+
+	return &corev3.Address{
+		Address: &corev3.Address_SocketAddress{
+			SocketAddress: &corev3.SocketAddress{
+				Protocol: corev3.SocketAddress_TCP,
+				Address:  addr.IP,
+				PortSpecifier: &corev3.SocketAddress_PortValue{
+					PortValue: portU32,
+				},
+			},
+		},
+	}
 }
@@ -0,0 +1,107 @@
+package snapshot
+
+import (
+	"testing"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestSnapshotter_serviceEndpointsToResources_localities(t *testing.T) {
+	s := &Snapshotter{
+		nodeTopology: map[string]locality{
+			"node-a": {Region: "asia", Zone: "asia-1a"},
+			"node-b": {Region: "asia", Zone: "asia-1b", SubZone: "rack1"},
+		},
+	}
+
+	out := s.serviceEndpointsToResources([]*serviceEndpoints{{
+		Name:      "app",
+		Namespace: "default",
+		Version:   "1",
+		Ports: map[string][]endpointAddress{
+			"grpc": {
+				{IP: "10.0.0.1", Port: 5000, NodeName: "node-b", HealthStatus: corev3.HealthStatus_HEALTHY},
+				{IP: "10.0.0.2", Port: 5000, NodeName: "node-a", HealthStatus: corev3.HealthStatus_DRAINING},
+				{IP: "10.0.0.3", Port: 5000, NodeName: "node-b", HealthStatus: corev3.HealthStatus_HEALTHY},
+				{IP: "10.0.0.4", Port: 5000, NodeName: "node-b", Zone: "asia-1c", HealthStatus: corev3.HealthStatus_UNHEALTHY},
+				{IP: "10.0.0.4", Port: 5000, NodeName: "node-b", Zone: "asia-1c", HealthStatus: corev3.HealthStatus_HEALTHY},
+				{IP: "10.0.0.5", Port: 5000, HealthStatus: corev3.HealthStatus_HEALTHY},
+				{IP: "10.0.0.6", Port: 5000, HealthStatus: corev3.HealthStatus_UNHEALTHY},
+			},
+		},
+	}})
+	require.Len(t, out["default/app"], 1)
+
+	cla := out["default/app"][0].(*endpointv3.ClusterLoadAssignment)
+	assert.Equal(t, "app.default:grpc", cla.ClusterName)
+	require.Len(t, cla.Endpoints, 4)
+
+	assert.Empty(t, cla.Endpoints[0].Locality.Zone)
+	assert.EqualValues(t, 1, cla.Endpoints[0].LoadBalancingWeight.GetValue())
+	assert.Len(t, cla.Endpoints[0].LbEndpoints, 2)
+
+	assert.Equal(t, "asia-1a", cla.Endpoints[1].Locality.Zone)
+	assert.EqualValues(t, 1, cla.Endpoints[1].LoadBalancingWeight.GetValue())
+	assert.Equal(t, corev3.HealthStatus_DRAINING, cla.Endpoints[1].LbEndpoints[0].HealthStatus)
+
+	assert.Equal(t, "asia-1b", cla.Endpoints[2].Locality.Zone)
+	assert.Equal(t, "rack1", cla.Endpoints[2].Locality.SubZone)
+	assert.EqualValues(t, 2, cla.Endpoints[2].LoadBalancingWeight.GetValue())
+	assert.Len(t, cla.Endpoints[2].LbEndpoints, 2)
+
+	assert.Equal(t, "asia", cla.Endpoints[3].Locality.Region)
+	assert.Equal(t, "asia-1c", cla.Endpoints[3].Locality.Zone)
+	assert.EqualValues(t, 1, cla.Endpoints[3].LoadBalancingWeight.GetValue())
+	assert.Equal(t, corev3.HealthStatus_HEALTHY, cla.Endpoints[3].LbEndpoints[0].HealthStatus)
+}
+
+func TestSnapshotter_serviceEndpointsToResources_additionalAddresses(t *testing.T) {
+	s := &Snapshotter{}
+	podA := &corev1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "app-a"}
+	podB := &corev1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "app-b"}
+
+	out := s.serviceEndpointsToResources([]*serviceEndpoints{{
+		Name:      "app",
+		Namespace: "default",
+		Version:   "1",
+		Ports: map[string][]endpointAddress{
+			"grpc": {
+				{IP: "fd00::1", Port: 5000, TargetRef: podA, HealthStatus: corev3.HealthStatus_HEALTHY},
+				{IP: "10.0.0.1", Port: 5000, TargetRef: podA, HealthStatus: corev3.HealthStatus_UNHEALTHY},
+				{IP: "10.0.0.2", Port: 5000, TargetRef: podB, HealthStatus: corev3.HealthStatus_HEALTHY},
+				{IP: "fd00::2", Port: 5000, TargetRef: podB, HealthStatus: corev3.HealthStatus_DRAINING},
+				{IP: "10.0.0.3", Port: 5000, HealthStatus: corev3.HealthStatus_HEALTHY},
+				{IP: "fd00::3", Port: 5000, HealthStatus: corev3.HealthStatus_HEALTHY},
+			},
+		},
+	}})
+	require.Len(t, out["default/app"], 1)
+
+	cla := out["default/app"][0].(*endpointv3.ClusterLoadAssignment)
+	require.Len(t, cla.Endpoints, 1)
+	lbEndpoints := cla.Endpoints[0].LbEndpoints
+	require.Len(t, lbEndpoints, 4)
+	assert.EqualValues(t, 3, cla.Endpoints[0].LoadBalancingWeight.GetValue())
+
+	// IPv4 address is the primary address of the pod
+	assert.Equal(t, "10.0.0.1", lbEndpoints[0].GetEndpoint().GetAddress().GetSocketAddress().GetAddress())
+	require.Len(t, lbEndpoints[0].GetEndpoint().GetAdditionalAddresses(), 1)
+	assert.Equal(t, "fd00::1", lbEndpoints[0].GetEndpoint().GetAdditionalAddresses()[0].GetAddress().GetSocketAddress().GetAddress())
+	// The healthier status wins as the slices of each IP family may be updated at different times
+	assert.Equal(t, corev3.HealthStatus_HEALTHY, lbEndpoints[0].HealthStatus)
+
+	assert.Equal(t, "10.0.0.2", lbEndpoints[1].GetEndpoint().GetAddress().GetSocketAddress().GetAddress())
+	require.Len(t, lbEndpoints[1].GetEndpoint().GetAdditionalAddresses(), 1)
+	assert.Equal(t, "fd00::2", lbEndpoints[1].GetEndpoint().GetAdditionalAddresses()[0].GetAddress().GetSocketAddress().GetAddress())
+	// but a terminating pod is draining
+	assert.Equal(t, corev3.HealthStatus_DRAINING, lbEndpoints[1].HealthStatus)
+
+	// Addresses without pods are listed separately
+	assert.Equal(t, "10.0.0.3", lbEndpoints[2].GetEndpoint().GetAddress().GetSocketAddress().GetAddress())
+	assert.Empty(t, lbEndpoints[2].GetEndpoint().GetAdditionalAddresses())
+	assert.Equal(t, "fd00::3", lbEndpoints[3].GetEndpoint().GetAddress().GetSocketAddress().GetAddress())
+}
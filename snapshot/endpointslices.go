@@ -0,0 +1,165 @@
+package snapshot
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/wongnai/xds/meter"
+	"go.opentelemetry.io/otel/metric"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	k8scache "k8s.io/client-go/tools/cache"
+)
+
+func (s *Snapshotter) startEndpointSlices(ctx context.Context) error {
+	emit := func() {}
+
+	reflector := s.newScopedReflector(&discoveryv1.EndpointSlice{}, func(namespace string) *k8scache.ListWatch {
+		return &k8scache.ListWatch{
+			ListWithContextFunc: func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+				return s.client.DiscoveryV1().EndpointSlices(namespace).List(ctx, options)
+			},
+			WatchFuncWithContext: func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
+				return s.client.DiscoveryV1().EndpointSlices(namespace).Watch(ctx, options)
+			},
+		}
+	}, func() {
+		emit()
+	})
+
+	refresh := func() {
+		endpoints := kubeEndpointSlicesToServiceEndpoints(sliceToEndpointSlices(reflector.List()))
+		s.emitEndpoints(reflector.LastSyncResourceVersion(), endpoints)
+	}
+
+	var once sync.Once
+	emit = func() {
+		s.kubeEventCounter.Add(ctx, 1, metric.WithAttributes(meter.ResourceAttrKey.String("endpointslices")))
+		refresh()
+		once.Do(func() {
+			s.setEndpointsRefresher(func() {
+				reflector.Locked(refresh)
+			})
+		})
+	}
+
+	reflector.Run(ctx)
+	return nil
+}
+
+func sliceToEndpointSlices(s []interface{}) []*discoveryv1.EndpointSlice {
+	out := make([]*discoveryv1.EndpointSlice, len(s))
+	for i, v := range s {
+		out[i] = v.(*discoveryv1.EndpointSlice)
+	}
+	return out
+}
+
+// kubeEndpointSlicesToServiceEndpoints merge all EndpointSlices of the same service into one serviceEndpoints
+//
+// Slices without the kubernetes.io/service-name label and FQDN slices are ignored
+func kubeEndpointSlicesToServiceEndpoints(slices []*discoveryv1.EndpointSlice) []*serviceEndpoints {
+	sort.SliceStable(slices, func(i, j int) bool {
+		if slices[i].Namespace == slices[j].Namespace {
+			return slices[i].Name < slices[j].Name
+		}
+		return slices[i].Namespace < slices[j].Namespace
+	})
+
+	var out []*serviceEndpoints
+	byService := map[string]*serviceEndpoints{}
+	versions := map[string][]string{}
+
+	for _, slice := range slices {
+		serviceName, ok := slice.Labels[discoveryv1.LabelServiceName]
+		if !ok || serviceName == "" {
+			continue
+		}
+		if slice.AddressType != discoveryv1.AddressTypeIPv4 && slice.AddressType != discoveryv1.AddressTypeIPv6 {
+			continue
+		}
+
+		key := slice.Namespace + "/" + serviceName
+		svcEndpoints, ok := byService[key]
+		if !ok {
+			svcEndpoints = &serviceEndpoints{
+				Name:      serviceName,
+				Namespace: slice.Namespace,
+				Ports:     map[string][]endpointAddress{},
+			}
+			byService[key] = svcEndpoints
+			out = append(out, svcEndpoints)
+		}
+		versions[key] = append(versions[key], slice.Name+"="+slice.ResourceVersion)
+
+		for _, port := range slice.Ports {
+			if port.Port == nil {
+				continue
+			}
+			portName := ""
+			if port.Name != nil {
+				portName = *port.Name
+			}
+			if portName == "" {
+				portName = strconv.Itoa(int(*port.Port))
+			}
+
+			addresses := svcEndpoints.Ports[portName]
+			for _, endpoint := range slice.Endpoints {
+				if len(endpoint.Addresses) == 0 {
+					continue
+				}
+
+				addr := endpointAddress{
+					// All addresses are fungible, and consumers may choose to use only the first one
+					IP:           endpoint.Addresses[0],
+					Port:         *port.Port,
+					TargetRef:    endpoint.TargetRef,
+					HealthStatus: endpointHealthStatus(endpoint.Conditions),
+				}
+				if endpoint.Hostname != nil {
+					addr.Hostname = *endpoint.Hostname
+				}
+				if endpoint.NodeName != nil {
+					addr.NodeName = *endpoint.NodeName
+				}
+				if endpoint.Zone != nil {
+					addr.Zone = *endpoint.Zone
+				}
+				addresses = append(addresses, addr)
+			}
+			svcEndpoints.Ports[portName] = addresses
+		}
+	}
+
+	for key, svcEndpoints := range byService {
+		svcEndpoints.Version = strings.Join(versions[key], ",")
+	}
+
+	return out
+}
+
+// endpointHealthStatus map EndpointSlice conditions to EDS health status
+//
+// - Terminating endpoints that are still serving are DRAINING, so clients can finish in-flight RPCs
+// - Ready endpoints are HEALTHY. Unknown readiness should be interpreted as ready
+// - Everything else is UNHEALTHY
+func endpointHealthStatus(conditions discoveryv1.EndpointConditions) corev3.HealthStatus {
+	serving := conditions.Serving == nil || *conditions.Serving
+	if conditions.Terminating != nil && *conditions.Terminating {
+		if serving {
+			return corev3.HealthStatus_DRAINING
+		}
+		return corev3.HealthStatus_UNHEALTHY
+	}
+	if conditions.Ready == nil || *conditions.Ready {
+		return corev3.HealthStatus_HEALTHY
+	}
+	return corev3.HealthStatus_UNHEALTHY
+}
@@ -0,0 +1,96 @@
+package snapshot
+
+import (
+	"testing"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+)
+
+func Test_kubeEndpointSlicesToServiceEndpoints(t *testing.T) {
+	newSlice := func(name string, addressType discoveryv1.AddressType, ip string, ready *bool) *discoveryv1.EndpointSlice {
+		return &discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            name,
+				Namespace:       "default",
+				ResourceVersion: "1",
+				Labels: map[string]string{
+					discoveryv1.LabelServiceName: "app",
+				},
+			},
+			AddressType: addressType,
+			Endpoints: []discoveryv1.Endpoint{{
+				Addresses:  []string{ip},
+				Conditions: discoveryv1.EndpointConditions{Ready: ready},
+			}},
+			Ports: []discoveryv1.EndpointPort{
+				{Name: ptr.To("grpc"), Port: ptr.To[int32](5000)},
+				{Port: ptr.To[int32](8080)},
+			},
+		}
+	}
+
+	unlabeled := newSlice("unlabeled", discoveryv1.AddressTypeIPv4, "10.0.0.9", nil)
+	unlabeled.Labels = nil
+
+	out := kubeEndpointSlicesToServiceEndpoints([]*discoveryv1.EndpointSlice{
+		newSlice("app-b", discoveryv1.AddressTypeIPv4, "10.0.0.2", ptr.To(true)),
+		newSlice("app-a", discoveryv1.AddressTypeIPv4, "10.0.0.1", nil),
+		newSlice("app-c", discoveryv1.AddressTypeIPv4, "10.0.0.3", ptr.To(false)),
+		newSlice("app-d", discoveryv1.AddressTypeFQDN, "example.com", nil),
+		unlabeled,
+	})
+	require.Len(t, out, 1)
+
+	assert.Equal(t, "app", out[0].Name)
+	assert.Equal(t, "default", out[0].Namespace)
+	assert.Equal(t, "app-a=1,app-b=1,app-c=1", out[0].Version)
+	require.Len(t, out[0].Ports["grpc"], 3)
+	assert.Equal(t, "10.0.0.1", out[0].Ports["grpc"][0].IP)
+	assert.Equal(t, "10.0.0.2", out[0].Ports["grpc"][1].IP)
+	assert.Equal(t, "10.0.0.3", out[0].Ports["grpc"][2].IP)
+	assert.Equal(t, corev3.HealthStatus_UNHEALTHY, out[0].Ports["grpc"][2].HealthStatus)
+	assert.Equal(t, int32(5000), out[0].Ports["grpc"][0].Port)
+	assert.Len(t, out[0].Ports["8080"], 3)
+}
+
+func Test_endpointHealthStatus(t *testing.T) {
+	for _, testcase := range []struct {
+		Name       string
+		Conditions discoveryv1.EndpointConditions
+		Expect     corev3.HealthStatus
+	}{
+		{
+			Name:   "unknown",
+			Expect: corev3.HealthStatus_HEALTHY,
+		},
+		{
+			Name:       "ready",
+			Conditions: discoveryv1.EndpointConditions{Ready: ptr.To(true), Serving: ptr.To(true), Terminating: ptr.To(false)},
+			Expect:     corev3.HealthStatus_HEALTHY,
+		},
+		{
+			Name:       "not ready",
+			Conditions: discoveryv1.EndpointConditions{Ready: ptr.To(false), Serving: ptr.To(false), Terminating: ptr.To(false)},
+			Expect:     corev3.HealthStatus_UNHEALTHY,
+		},
+		{
+			Name:       "terminating and serving",
+			Conditions: discoveryv1.EndpointConditions{Ready: ptr.To(false), Serving: ptr.To(true), Terminating: ptr.To(true)},
+			Expect:     corev3.HealthStatus_DRAINING,
+		},
+		{
+			Name:       "terminating",
+			Conditions: discoveryv1.EndpointConditions{Ready: ptr.To(false), Serving: ptr.To(false), Terminating: ptr.To(true)},
+			Expect:     corev3.HealthStatus_UNHEALTHY,
+		},
+	} {
+		t.Run(testcase.Name, func(t *testing.T) {
+			assert.Equal(t, testcase.Expect, endpointHealthStatus(testcase.Conditions))
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package snapshot
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ccoveille/go-safecast"
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// AnnotationExternalName is the DNS name of a service outside the cluster. Calls to the service go to the DNS name
+// instead of the service's endpoints, as with ExternalName services
+const AnnotationExternalName = "xds.lmwn.com/external-name"
+
+// isExternal return whether the service is an ExternalName service or has the external-name annotation
+func isExternal(service *corev1.Service) bool {
+	_, ok := service.GetAnnotations()[AnnotationExternalName]
+	return ok || service.Spec.Type == corev1.ServiceTypeExternalName
+}
+
+// externalNameFromService return the DNS name of an external service.
+// It returns empty string if the service is not external or the name is invalid
+func externalNameFromService(service *corev1.Service) string {
+	externalName, ok := service.GetAnnotations()[AnnotationExternalName]
+	if !ok {
+		if service.Spec.Type != corev1.ServiceTypeExternalName {
+			return ""
+		}
+		externalName = service.Spec.ExternalName
+	}
+
+	if err := validateExternalName(externalName); err != nil {
+		klog.ErrorS(err, "invalid external name", "object", klog.KObj(service), "external-name", externalName)
+		return ""
+	}
+	return externalName
+}
+
+func validateExternalName(v string) error {
+	if v == "" {
+		return fmt.Errorf("external name is empty")
+	}
+	if strings.ContainsAny(v, ":/ ") {
+		return fmt.Errorf("external name must be a host name without port")
+	}
+	return nil
+}
+
+// applyExternalName turn the cluster of the port into a LOGICAL_DNS cluster of the service's external name
+// and the port number. The cluster is left as EDS if the service is not external.
+// It returns false if the port number is invalid, in which case the port should be skipped
+//
+// The cluster is as in gRPC [A37](https://github.com/grpc/proposal/blob/master/A37-xds-aggregate-and-logical-dns-clusters.md)
+func applyExternalName(service *corev1.Service, port corev1.ServicePort, cluster *clusterv3.Cluster) bool {
+	externalName := externalNameFromService(service)
+	if externalName == "" {
+		return true
+	}
+	portU32, err := safecast.ToUint32(port.Port)
+	if err != nil {
+		klog.ErrorS(err, "invalid external port", "object", klog.KObj(service), "port", port.Port)
+		return false
+	}
+
+	cluster.ClusterDiscoveryType = &clusterv3.Cluster_Type{Type: clusterv3.Cluster_LOGICAL_DNS}
+	cluster.EdsClusterConfig = nil
+	cluster.LoadAssignment = &endpointv3.ClusterLoadAssignment{
+		ClusterName: cluster.Name,
+		Endpoints: []*endpointv3.LocalityLbEndpoints{{
+			LbEndpoints: []*endpointv3.LbEndpoint{{
+				HostIdentifier: &endpointv3.LbEndpoint_Endpoint{
+					Endpoint: &endpointv3.Endpoint{
+						Address: &corev3.Address{
+							Address: &corev3.Address_SocketAddress{
+								SocketAddress: &corev3.SocketAddress{
+									Address: externalName,
+									PortSpecifier: &corev3.SocketAddress_PortValue{
+										PortValue: portU32,
+									},
+								},
+							},
+						},
+					},
+				},
+			}},
+		}},
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+package snapshot
+
+import (
+	"testing"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_externalNameFromService(t *testing.T) {
+	for _, testcase := range []struct {
+		Name        string
+		Type        corev1.ServiceType
+		Annotations map[string]string
+		Expect      string
+	}{
+		{
+			Name: "ClusterIP",
+			Type: corev1.ServiceTypeClusterIP,
+		},
+		{
+			Name:   "ExternalName",
+			Type:   corev1.ServiceTypeExternalName,
+			Expect: "api.example.com",
+		},
+		{
+			Name:        "annotation",
+			Type:        corev1.ServiceTypeClusterIP,
+			Annotations: map[string]string{AnnotationExternalName: "other.example.com"},
+			Expect:      "other.example.com",
+		},
+		{
+			Name:        "annotation overrides ExternalName",
+			Type:        corev1.ServiceTypeExternalName,
+			Annotations: map[string]string{AnnotationExternalName: "other.example.com"},
+			Expect:      "other.example.com",
+		},
+		{
+			Name:        "empty",
+			Type:        corev1.ServiceTypeClusterIP,
+			Annotations: map[string]string{AnnotationExternalName: ""},
+		},
+		{
+			Name:        "with port",
+			Type:        corev1.ServiceTypeClusterIP,
+			Annotations: map[string]string{AnnotationExternalName: "other.example.com:443"},
+		},
+	} {
+		t.Run(testcase.Name, func(t *testing.T) {
+			assert.Equal(t, testcase.Expect, externalNameFromService(&corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "app",
+					Namespace:   "default",
+					Annotations: testcase.Annotations,
+				},
+				Spec: corev1.ServiceSpec{
+					Type:         testcase.Type,
+					ExternalName: "api.example.com",
+				},
+			}))
+		})
+	}
+}
+
+func Test_applyExternalName(t *testing.T) {
+	resources := kubeServicesToResources([]*corev1.Service{{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "api",
+			Namespace: "default",
+		},
+		Spec: corev1.ServiceSpec{
+			Type:         corev1.ServiceTypeExternalName,
+			ExternalName: "api.example.com",
+			Ports: []corev1.ServicePort{{
+				Name: "grpc",
+				Port: 443,
+			}},
+		},
+	}}, MTLS{Namespaces: []string{"default"}})
+
+	var cluster *clusterv3.Cluster
+	for _, res := range resources {
+		if c, ok := res.(*clusterv3.Cluster); ok {
+			cluster = c
+		}
+	}
+	require.NotNil(t, cluster)
+	assert.Equal(t, "api.default:grpc", cluster.Name)
+	assert.Equal(t, clusterv3.Cluster_LOGICAL_DNS, cluster.GetType())
+	assert.Nil(t, cluster.EdsClusterConfig)
+	assert.Nil(t, cluster.TransportSocket)
+
+	require.Len(t, cluster.LoadAssignment.GetEndpoints(), 1)
+	require.Len(t, cluster.LoadAssignment.Endpoints[0].LbEndpoints, 1)
+	address := cluster.LoadAssignment.Endpoints[0].LbEndpoints[0].GetEndpoint().GetAddress().GetSocketAddress()
+	assert.Equal(t, "api.example.com", address.GetAddress())
+	assert.Equal(t, uint32(443), address.GetPortValue())
+}
+
+func Test_applyExternalName_invalidPort(t *testing.T) {
+	resources := kubeServicesToResources([]*corev1.Service{{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "api",
+			Namespace: "default",
+		},
+		Spec: corev1.ServiceSpec{
+			Type:         corev1.ServiceTypeExternalName,
+			ExternalName: "api.example.com",
+			Ports: []corev1.ServicePort{
+				{Name: "invalid", Port: -1},
+				{Name: "grpc", Port: 443},
+			},
+		},
+	}}, MTLS{})
+
+	var clusters []string
+	for _, res := range resources {
+		if c, ok := res.(*clusterv3.Cluster); ok {
+			clusters = append(clusters, c.Name)
+		}
+	}
+	assert.Equal(t, []string{"api.default:grpc"}, clusters)
+}
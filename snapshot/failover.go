@@ -0,0 +1,106 @@
+package snapshot
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	aggregatev3 "github.com/envoyproxy/go-control-plane/envoy/extensions/clusters/aggregate/v3"
+	"google.golang.org/protobuf/types/known/anypb"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// AnnotationFailover is the service to fail over to when the service has no available endpoints,
+// in form of [namespace/]service[:port]. The namespace defaults to the service's namespace,
+// and the port defaults to the port of the same name
+const AnnotationFailover = "xds.lmwn.com/failover"
+
+const aggregateClusterType = "envoy.clusters.aggregate"
+
+type failoverTarget struct {
+	Namespace string
+	Service   string
+	Port      string
+}
+
+// failoverClusterFromService convert the failover annotation on the Kubernetes service to an aggregate cluster
+// of the port, which prefers the port's cluster and falls back to the target service's cluster.
+// It may return nil if not configured, or if the target service or its port is not known
+//
+// The aggregate cluster is as in gRPC [A37](https://github.com/grpc/proposal/blob/master/A37-xds-aggregate-and-logical-dns-clusters.md)
+func failoverClusterFromService(service *corev1.Service, port corev1.ServicePort, services map[string]*corev1.Service) *clusterv3.Cluster {
+	failover, ok := service.GetAnnotations()[AnnotationFailover]
+	if !ok {
+		return nil
+	}
+
+	target, err := parseFailover(failover, service.Namespace, port.Name)
+	if err == nil {
+		var fallback string
+		fallback, err = serviceCluster(target.Namespace, target.Service, target.Port, services)
+		primary := net.JoinHostPort(fmt.Sprintf("%s.%s", service.Name, service.Namespace), port.Name)
+		if err == nil && fallback == primary {
+			err = fmt.Errorf("service cannot fail over to itself")
+		}
+		if err == nil {
+			return aggregateCluster(failoverClusterName(primary), primary, fallback)
+		}
+	}
+	klog.ErrorS(err, "invalid failover", "object", klog.KObj(service), "failover", failover)
+	return nil
+}
+
+// failoverClusterName return the name of the aggregate cluster of the cluster
+func failoverClusterName(cluster string) string {
+	return cluster + "/failover"
+}
+
+// aggregateCluster build an aggregate cluster of the clusters in order of priority
+func aggregateCluster(name string, clusters ...string) *clusterv3.Cluster {
+	config, _ := anypb.New(&aggregatev3.ClusterConfig{
+		Clusters: clusters,
+	})
+	return &clusterv3.Cluster{
+		Name: name,
+		ClusterDiscoveryType: &clusterv3.Cluster_ClusterType{
+			ClusterType: &clusterv3.Cluster_CustomClusterType{
+				Name:        aggregateClusterType,
+				TypedConfig: config,
+			},
+		},
+		LbPolicy: clusterv3.Cluster_ROUND_ROBIN,
+	}
+}
+
+func parseFailover(v string, namespace string, portName string) (failoverTarget, error) {
+	out := failoverTarget{
+		Namespace: namespace,
+		Port:      portName,
+	}
+
+	target, port, hasPort := strings.Cut(strings.TrimSpace(v), ":")
+	if hasPort {
+		out.Port = strings.TrimSpace(port)
+		if out.Port == "" {
+			return failoverTarget{}, fmt.Errorf("failover %q has no port", v)
+		}
+	}
+
+	targetNamespace, service, hasNamespace := strings.Cut(target, "/")
+	if hasNamespace {
+		out.Namespace = strings.TrimSpace(targetNamespace)
+		if out.Namespace == "" {
+			return failoverTarget{}, fmt.Errorf("failover %q has no namespace", v)
+		}
+	} else {
+		service = targetNamespace
+	}
+	out.Service = strings.TrimSpace(service)
+	if out.Service == "" {
+		return failoverTarget{}, fmt.Errorf("failover %q has no service", v)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,105 @@
+package snapshot
+
+import (
+	"testing"
+
+	aggregatev3 "github.com/envoyproxy/go-control-plane/envoy/extensions/clusters/aggregate/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_parseFailover(t *testing.T) {
+	for _, testcase := range []struct {
+		Input     string
+		Expect    failoverTarget
+		ExpectErr bool
+	}{
+		{
+			Input:  "foo-fallback",
+			Expect: failoverTarget{Namespace: "default", Service: "foo-fallback", Port: "grpc"},
+		},
+		{
+			Input:  " other/foo ",
+			Expect: failoverTarget{Namespace: "other", Service: "foo", Port: "grpc"},
+		},
+		{
+			Input:  "other/foo:http",
+			Expect: failoverTarget{Namespace: "other", Service: "foo", Port: "http"},
+		},
+		{
+			Input:     "",
+			ExpectErr: true,
+		},
+		{
+			Input:     "/foo",
+			ExpectErr: true,
+		},
+		{
+			Input:     "other/",
+			ExpectErr: true,
+		},
+		{
+			Input:     "foo:",
+			ExpectErr: true,
+		},
+	} {
+		t.Run(testcase.Input, func(t *testing.T) {
+			out, err := parseFailover(testcase.Input, "default", "grpc")
+			if testcase.ExpectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testcase.Expect, out)
+		})
+	}
+}
+
+func Test_failoverClusterFromService(t *testing.T) {
+	service := func(name string, namespace string, annotations map[string]string, ports ...string) *corev1.Service {
+		out := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   namespace,
+				Annotations: annotations,
+			},
+		}
+		for _, port := range ports {
+			out.Spec.Ports = append(out.Spec.Ports, corev1.ServicePort{Name: port})
+		}
+		return out
+	}
+
+	services := servicesByName([]*corev1.Service{
+		service("foo", "default", nil, "grpc", "http"),
+		service("foo", "other", nil, "grpc"),
+	})
+	port := corev1.ServicePort{Name: "grpc"}
+
+	out := failoverClusterFromService(service("foo", "default", map[string]string{
+		AnnotationFailover: "other/foo",
+	}), port, services)
+	require.NotNil(t, out)
+	assert.Equal(t, "foo.default:grpc/failover", out.Name)
+	assert.Equal(t, aggregateClusterType, out.GetClusterType().GetName())
+	config := &aggregatev3.ClusterConfig{}
+	require.NoError(t, out.GetClusterType().GetTypedConfig().UnmarshalTo(config))
+	assert.Equal(t, []string{"foo.default:grpc", "foo.other:grpc"}, config.Clusters)
+
+	assert.Nil(t, failoverClusterFromService(service("foo", "default", nil), port, services))
+
+	// The target must be known
+	assert.Nil(t, failoverClusterFromService(service("foo", "default", map[string]string{
+		AnnotationFailover: "bar",
+	}), port, services))
+	assert.Nil(t, failoverClusterFromService(service("foo", "default", map[string]string{
+		AnnotationFailover: "other/foo:http",
+	}), port, services))
+
+	// The service cannot fail over to itself
+	assert.Nil(t, failoverClusterFromService(service("foo", "default", map[string]string{
+		AnnotationFailover: "foo",
+	}), port, services))
+}
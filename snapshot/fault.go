@@ -0,0 +1,112 @@
+package snapshot
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	faultcommonv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/common/fault/v3"
+	faultv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/fault/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/types/known/durationpb"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const AnnotationFaultDelay = "xds.lmwn.com/fault-delay"
+const AnnotationFaultDelayPercent = "xds.lmwn.com/fault-delay-percent"
+const AnnotationFaultAbort = "xds.lmwn.com/fault-abort"
+const AnnotationFaultAbortPercent = "xds.lmwn.com/fault-abort-percent"
+
+// faultFromService convert annotations on the Kubernetes service to xDS fault injection
+// It may return nil if neither delay nor abort is configured
+//
+// The supported values are as in gRPC [A33](https://github.com/grpc/proposal/blob/master/A33-Fault-Injection.md)
+func faultFromService(service *corev1.Service) *faultv3.HTTPFault {
+	annotations := service.GetAnnotations()
+	out := &faultv3.HTTPFault{}
+
+	delay, ok := annotations[AnnotationFaultDelay]
+	if ok {
+		parsed, err := parseNonNegativeDuration(delay)
+		if err != nil {
+			klog.ErrorS(err, "cannot parse fault-delay", "object", klog.KObj(service), "fault-delay", delay)
+		} else if percentage, ok := parseFaultPercent(service, AnnotationFaultDelayPercent); ok {
+			out.Delay = &faultcommonv3.FaultDelay{
+				FaultDelaySecifier: &faultcommonv3.FaultDelay_FixedDelay{
+					FixedDelay: durationpb.New(parsed),
+				},
+				Percentage: percentage,
+			}
+		}
+	}
+
+	abort, ok := annotations[AnnotationFaultAbort]
+	if ok {
+		code, err := parseGrpcStatus(abort)
+		if err != nil {
+			klog.ErrorS(err, "cannot parse fault-abort", "object", klog.KObj(service), "fault-abort", abort)
+		} else if percentage, ok := parseFaultPercent(service, AnnotationFaultAbortPercent); ok {
+			out.Abort = &faultv3.FaultAbort{
+				ErrorType: &faultv3.FaultAbort_GrpcStatus{
+					GrpcStatus: uint32(code),
+				},
+				Percentage: percentage,
+			}
+		}
+	}
+
+	if out.Delay == nil && out.Abort == nil {
+		return nil
+	}
+	return out
+}
+
+// parseFaultPercent parse the percentage annotation. It default to 100% if not set.
+// ok is false if the annotation is invalid, in which case the fault should be left out
+// rather than injected into every call
+func parseFaultPercent(service *corev1.Service, annotation string) (percentage *typev3.FractionalPercent, ok bool) {
+	value, ok := service.GetAnnotations()[annotation]
+	if !ok {
+		return &typev3.FractionalPercent{Numerator: 100, Denominator: typev3.FractionalPercent_HUNDRED}, true
+	}
+	parsed, err := parseFractionalPercent(value)
+	if err != nil {
+		klog.ErrorS(err, "cannot parse percentage", "object", klog.KObj(service), "annotation", annotation, "value", value)
+		return nil, false
+	}
+	return parsed, true
+}
+
+// parseFractionalPercent parse percentage from 0 to 100 with up to 4 decimal places
+func parseFractionalPercent(v string) (*typev3.FractionalPercent, error) {
+	parsed, err := strconv.ParseFloat(strings.TrimSuffix(v, "%"), 64)
+	if err != nil {
+		return nil, err
+	}
+	if parsed < 0 || parsed > 100 {
+		return nil, fmt.Errorf("percentage must be between 0 and 100")
+	}
+	return &typev3.FractionalPercent{
+		Numerator:   uint32(math.Round(parsed * 10000)),
+		Denominator: typev3.FractionalPercent_MILLION,
+	}, nil
+}
+
+// parseGrpcStatus parse gRPC status code by its number or name, such as "unavailable" or "deadline-exceeded"
+func parseGrpcStatus(v string) (codes.Code, error) {
+	var out codes.Code
+	name := strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(v), "-", "_"))
+	if _, err := strconv.ParseUint(name, 10, 32); err != nil {
+		name = strconv.Quote(name)
+	}
+	if err := out.UnmarshalJSON([]byte(name)); err != nil {
+		return 0, err
+	}
+	if out == codes.OK {
+		return 0, fmt.Errorf("cannot abort with OK status")
+	}
+	return out, nil
+}
@@ -0,0 +1,99 @@
+package snapshot
+
+import (
+	"testing"
+	"time"
+
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_parseGrpcStatus(t *testing.T) {
+	for _, testcase := range []struct {
+		Input     string
+		Expect    codes.Code
+		ExpectErr bool
+	}{
+		{Input: "unavailable", Expect: codes.Unavailable},
+		{Input: "deadline-exceeded", Expect: codes.DeadlineExceeded},
+		{Input: "RESOURCE_EXHAUSTED", Expect: codes.ResourceExhausted},
+		{Input: "13", Expect: codes.Internal},
+		{Input: "ok", ExpectErr: true},
+		{Input: "invalid", ExpectErr: true},
+		{Input: "100", ExpectErr: true},
+	} {
+		t.Run(testcase.Input, func(t *testing.T) {
+			out, err := parseGrpcStatus(testcase.Input)
+			if testcase.ExpectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testcase.Expect, out)
+		})
+	}
+}
+
+func Test_parseFractionalPercent(t *testing.T) {
+	for _, testcase := range []struct {
+		Input     string
+		Expect    uint32
+		ExpectErr bool
+	}{
+		{Input: "100", Expect: 1000000},
+		{Input: "0.5", Expect: 5000},
+		{Input: "12.5%", Expect: 125000},
+		{Input: "0", Expect: 0},
+		{Input: "101", ExpectErr: true},
+		{Input: "-1", ExpectErr: true},
+		{Input: "abc", ExpectErr: true},
+	} {
+		t.Run(testcase.Input, func(t *testing.T) {
+			out, err := parseFractionalPercent(testcase.Input)
+			if testcase.ExpectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, typev3.FractionalPercent_MILLION, out.Denominator)
+			assert.Equal(t, testcase.Expect, out.Numerator)
+		})
+	}
+}
+
+func Test_faultFromService(t *testing.T) {
+	assert.Nil(t, faultFromService(&corev1.Service{}))
+
+	out := faultFromService(newTestService(map[string]string{
+		AnnotationFaultDelay:        "100ms",
+		AnnotationFaultAbort:        "unavailable",
+		AnnotationFaultAbortPercent: "10",
+	}))
+	require.NotNil(t, out)
+	assert.Equal(t, 100*time.Millisecond, out.Delay.GetFixedDelay().AsDuration())
+	assert.Equal(t, uint32(100), out.Delay.Percentage.Numerator)
+	assert.Equal(t, typev3.FractionalPercent_HUNDRED, out.Delay.Percentage.Denominator)
+	assert.Equal(t, uint32(codes.Unavailable), out.Abort.GetGrpcStatus())
+	assert.Equal(t, uint32(100000), out.Abort.Percentage.Numerator)
+}
+
+func Test_faultFromService_invalidPercent(t *testing.T) {
+	// Invalid percentages leave the fault out instead of injecting it into every call
+	out := faultFromService(newTestService(map[string]string{
+		AnnotationFaultDelay:        "100ms",
+		AnnotationFaultDelayPercent: "50%%",
+		AnnotationFaultAbort:        "unavailable",
+		AnnotationFaultAbortPercent: "10",
+	}))
+	require.NotNil(t, out)
+	assert.Nil(t, out.Delay)
+	assert.Equal(t, uint32(codes.Unavailable), out.Abort.GetGrpcStatus())
+
+	assert.Nil(t, faultFromService(newTestService(map[string]string{
+		AnnotationFaultAbort:        "unavailable",
+		AnnotationFaultAbortPercent: "150",
+	})))
+}
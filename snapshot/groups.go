@@ -0,0 +1,308 @@
+package snapshot
+
+import (
+	"context"
+	"slices"
+	"strconv"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+	"github.com/wongnai/xds/snapshot/apigateway"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+var (
+	serviceTypeURLs  = []string{resource.ListenerType, resource.RouteType, resource.ClusterType}
+	endpointTypeURLs = []string{resource.EndpointType}
+)
+
+// groupState is the published resources of a node group, by type URL
+type groupState struct {
+	caches map[string]*resourceCache
+	// serviceResources is the last built resources of the services by type URL, which are published along with
+	// the resources built from the endpoints
+	serviceResources map[string][]types.Resource
+	// watches is the number of open watches of the group. Groups without watches are evicted
+	watches int
+}
+
+func newGroupState(versionPrefix string) *groupState {
+	out := &groupState{
+		caches: map[string]*resourceCache{},
+	}
+	for _, typeURL := range append(serviceTypeURLs, endpointTypeURLs...) {
+		out.caches[typeURL] = newResourceCache(typeURL, versionPrefix)
+	}
+	return out
+}
+
+// nodeGroupCache route watches to the resource cache of the node's group and type.
+// Resources are built on the first watch of a node group, so that they are only built
+// for node groups that have clients
+type nodeGroupCache struct {
+	snapshotter *Snapshotter
+}
+
+func (c nodeGroupCache) CreateWatch(request *cache.Request, state stream.StreamState, value chan cache.Response) func() {
+	group, release := c.snapshotter.acquireNodeGroup(NodeGroup{}.ID(request.GetNode()))
+	resourceCache, ok := group.caches[request.GetTypeUrl()]
+	if !ok {
+		release()
+		value <- nil
+		return nil
+	}
+	return releaseOnCancel(resourceCache.CreateWatch(request, state, value), release)
+}
+
+func (c nodeGroupCache) CreateDeltaWatch(request *cache.DeltaRequest, state stream.StreamState, value chan cache.DeltaResponse) func() {
+	group, release := c.snapshotter.acquireNodeGroup(NodeGroup{}.ID(request.GetNode()))
+	resourceCache, ok := group.caches[request.GetTypeUrl()]
+	if !ok {
+		release()
+		value <- nil
+		return nil
+	}
+	return releaseOnCancel(resourceCache.CreateDeltaWatch(request, state, value), release)
+}
+
+func (c nodeGroupCache) Fetch(ctx context.Context, request *cache.Request) (cache.Response, error) {
+	group, release := c.snapshotter.acquireNodeGroup(NodeGroup{}.ID(request.GetNode()))
+	defer release()
+	resourceCache, ok := group.caches[request.GetTypeUrl()]
+	if !ok {
+		return nil, nil
+	}
+	return resourceCache.Fetch(ctx, request)
+}
+
+// releaseOnCancel release the node group once the watch is cancelled.
+// A nil cancel means the watch has already responded, so the group is released right away
+func releaseOnCancel(cancel func(), release func()) func() {
+	if cancel == nil {
+		release()
+		return nil
+	}
+	return func() {
+		cancel()
+		release()
+	}
+}
+
+// acquireNodeGroup publish the resources of the node group if it is not known yet.
+// The group is not evicted until release is called
+func (s *Snapshotter) acquireNodeGroup(id string) (state *groupState, release func()) {
+	s.groupsLock.Lock()
+	defer s.groupsLock.Unlock()
+
+	state, ok := s.groups[id]
+	if !ok {
+		klog.V(2).InfoS("new node group", "group", id)
+		// Versions of an evicted group must not be mistaken as current when the group is created again
+		s.groupsCreated++
+		state = newGroupState(s.versionPrefix + strconv.FormatUint(s.groupsCreated, 36) + "-")
+		s.groups[id] = state
+		s.publishServices(id, state)
+		s.publishEndpoints(id, state)
+		s.publishServiceResources(id, state)
+	}
+
+	state.watches++
+	return state, func() {
+		s.groupsLock.Lock()
+		defer s.groupsLock.Unlock()
+		state.watches--
+	}
+}
+
+// evictIdleNodeGroups remove the node groups without watches, except GlobalNodeGroup.
+// They are evicted on the next change rather than when their last watch is cancelled,
+// as streams cancel their watch right before creating the next one
+// s.groupsLock must be held
+func (s *Snapshotter) evictIdleNodeGroups() {
+	for id, state := range s.groups {
+		if id != GlobalNodeGroup && state.watches == 0 {
+			klog.V(2).InfoS("evict node group", "group", id)
+			delete(s.groups, id)
+		}
+	}
+}
+
+// setServices replace the known services and republish all node groups
+func (s *Snapshotter) setServices(version string, services []*corev1.Service) {
+	s.groupsLock.Lock()
+	defer s.groupsLock.Unlock()
+
+	s.services = services
+	s.servicesVersion = version
+	s.servicesSynced = true
+
+	s.evictIdleNodeGroups()
+	for id, state := range s.groups {
+		s.publishServices(id, state)
+		// Visibility of the endpoints follow their service
+		s.publishEndpoints(id, state)
+		s.publishServiceResources(id, state)
+	}
+}
+
+// setEndpointResources replace the known endpoints and their resources, keyed by the service's namespace/name,
+// and republish all node groups
+func (s *Snapshotter) setEndpointResources(version string, endpoints []*serviceEndpoints, resources map[string][]types.Resource) {
+	s.groupsLock.Lock()
+	defer s.groupsLock.Unlock()
+
+	s.serviceEndpoints = make(map[string]*serviceEndpoints, len(endpoints))
+	for _, ep := range endpoints {
+		s.serviceEndpoints[ep.Namespace+"/"+ep.Name] = ep
+	}
+	s.endpointResources = resources
+	s.endpointsVersion = version
+	s.endpointsSynced = true
+
+	// Drop the server Listeners and pod services of services that no longer have endpoints
+	for name := range s.serverListenerCache {
+		if _, ok := s.serviceEndpoints[name]; !ok {
+			delete(s.serverListenerCache, name)
+		}
+	}
+	for name := range s.podServiceCache {
+		if _, ok := s.serviceEndpoints[name]; !ok {
+			delete(s.podServiceCache, name)
+		}
+	}
+
+	s.evictIdleNodeGroups()
+	for id, state := range s.groups {
+		s.publishEndpoints(id, state)
+		s.publishServiceResources(id, state)
+	}
+}
+
+// publishServices build the services resources of the node group. They are published by publishServiceResources
+// s.groupsLock must be held
+func (s *Snapshotter) publishServices(id string, state *groupState) {
+	if !s.servicesSynced {
+		return
+	}
+
+	services := visibleServices(s.services, nodeGroupFromID(id))
+	resources := kubeServicesToResources(services, s.mtls)
+	apiGatewayResources, apiGatewayStats := apigateway.FromKubeServices(services)
+	merged := append(resources, apiGatewayResources...) //nolint:gocritic
+
+	resourcesByType := resourcesToMap(merged)
+	if id == GlobalNodeGroup {
+		s.setServiceResourcesByType(resourcesByType)
+		s.setAPIGatewayStats(apiGatewayStats)
+	}
+
+	state.serviceResources = resourcesByType
+}
+
+// publishServiceResources publish the resources of the services along with the server Listeners and
+// the resources of the pods of headless services, which are built from the endpoints, and publish the changed ones
+// s.groupsLock must be held
+func (s *Snapshotter) publishServiceResources(id string, state *groupState) {
+	if !s.servicesSynced {
+		return
+	}
+
+	resourcesByType := make(map[string][]types.Resource, len(serviceTypeURLs))
+	for _, typeURL := range serviceTypeURLs {
+		resourcesByType[typeURL] = slices.Clip(state.serviceResources[typeURL])
+	}
+	if s.endpointsSynced {
+		services := visibleServices(s.services, nodeGroupFromID(id))
+		resources := append(s.serverListeners(services), s.podServiceResources(services)...)
+		for typeURL, typeResources := range resourcesToMap(resources) {
+			resourcesByType[typeURL] = append(resourcesByType[typeURL], typeResources...)
+		}
+	}
+
+	s.publishResources(id, state, serviceTypeURLs, resourcesByType, s.servicesVersion)
+}
+
+// publishEndpoints build the endpoints resources of the node group and publish the changed ones
+// s.groupsLock must be held
+func (s *Snapshotter) publishEndpoints(id string, state *groupState) {
+	if !s.endpointsSynced {
+		return
+	}
+
+	var resources []types.Resource
+	group := nodeGroupFromID(id)
+	services := visibleServices(s.services, group)
+	// Services with address mode other than pod replace the resources of their endpoints
+	addressResources := serviceAddressesToResources(services)
+	if group == (nodeGroup{}) {
+		for name, serviceResources := range s.endpointResources {
+			if _, ok := addressResources[name]; ok {
+				continue
+			}
+			resources = append(resources, serviceResources...)
+		}
+		for _, serviceResources := range addressResources {
+			resources = append(resources, serviceResources...)
+		}
+	} else {
+		for _, svc := range services {
+			name := svc.Namespace + "/" + svc.Name
+			if serviceResources, ok := addressResources[name]; ok {
+				resources = append(resources, serviceResources...)
+				continue
+			}
+			resources = append(resources, s.endpointResources[name]...)
+		}
+	}
+
+	resourcesByType := resourcesToMap(resources)
+	if id == GlobalNodeGroup {
+		s.setEndpointResourcesByType(resourcesByType)
+	}
+
+	s.publishResources(id, state, endpointTypeURLs, resourcesByType, s.endpointsVersion)
+}
+
+func (s *Snapshotter) publishResources(id string, state *groupState, typeURLs []string, resourcesByType map[string][]types.Resource, version string) {
+	for _, typeURL := range typeURLs {
+		updated, deleted := state.caches[typeURL].SetResources(resourcesByType[typeURL])
+		if updated == 0 && deleted == 0 {
+			klog.V(5).InfoS("resources are unchanged", "group", id, "type", typeURL)
+			continue
+		}
+		klog.V(4).InfoS("publish resources", "group", id, "type", typeURL, "version", version, "updated", updated, "deleted", deleted)
+	}
+}
+
+// PublishedResources is the resources of a node group and type, with the version each resource last changed
+type PublishedResources struct {
+	Resources map[string]types.Resource
+	Versions  map[string]string
+}
+
+// PublishedResources return the resources published to each node group, keyed by group and type URL
+func (s *Snapshotter) PublishedResources() map[string]map[resource.Type]PublishedResources {
+	s.groupsLock.Lock()
+	defer s.groupsLock.Unlock()
+
+	out := make(map[string]map[resource.Type]PublishedResources, len(s.groups))
+	for id, state := range s.groups {
+		groupMap := map[resource.Type]PublishedResources{}
+		out[id] = groupMap
+
+		for typeURL, resourceCache := range state.caches {
+			resources, versions := resourceCache.GetResources()
+			if len(resources) == 0 {
+				continue
+			}
+			groupMap[typeURL] = PublishedResources{
+				Resources: resources,
+				Versions:  versions,
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,59 @@
+package snapshot
+
+import (
+	"testing"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/structpb"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestNodeGroupCache_evict(t *testing.T) {
+	s := New(fake.NewClientset())
+	metadata, err := structpb.NewStruct(map[string]interface{}{NodeMetadataNamespace: "default"})
+	require.NoError(t, err)
+	node := &corev3.Node{Id: "test", Metadata: metadata}
+	id := NodeGroup{}.ID(node)
+
+	watch := func(version string) (chan cache.Response, func()) {
+		value := make(chan cache.Response, 1)
+		cancel := s.Cache().CreateWatch(&cache.Request{Node: node, TypeUrl: resource.ClusterType, VersionInfo: version}, stream.NewStreamState(false, nil), value)
+		return value, cancel
+	}
+
+	// Watches are held until the services are known
+	value, cancel := watch("")
+	require.NotNil(t, cancel)
+	s.setServices("1", nil)
+	require.Contains(t, s.groups, id)
+	require.Len(t, value, 1)
+	version := (<-value).(*cache.RawResponse).Version
+
+	// The group is kept while it has watches
+	_, cancel2 := watch(version)
+	require.NotNil(t, cancel2)
+	cancel()
+	s.setServices("2", nil)
+	assert.Contains(t, s.groups, id)
+
+	// and evicted on the next change after its last watch is cancelled
+	cancel2()
+	assert.Contains(t, s.groups, id)
+	s.setServices("3", nil)
+	assert.NotContains(t, s.groups, id)
+	assert.Contains(t, s.groups, GlobalNodeGroup)
+
+	// Versions of the evicted group are stale to the new group
+	value, _ = watch(version)
+	require.Len(t, value, 1)
+	assert.NotEqual(t, version, (<-value).(*cache.RawResponse).Version)
+
+	// Watches that respond right away do not hold the group
+	s.setServices("4", nil)
+	assert.NotContains(t, s.groups, id)
+}
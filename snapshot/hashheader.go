@@ -0,0 +1,64 @@
+package snapshot
+
+import (
+	"fmt"
+	"strings"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// AnnotationHashHeader is the request header to consistently hash calls by, optionally followed by
+// comma-separated ring_hash parameters. For example, "x-user-id,min_ring_size=1024,max_ring_size=4096"
+const AnnotationHashHeader = "xds.lmwn.com/hash-header"
+
+// hashHeaderFromService return the header and the ring hash policy of the hash-header annotation.
+// ok is false if the annotation is not set or is invalid
+func hashHeaderFromService(service *corev1.Service) (header string, ringHash *clusterv3.Cluster, ok bool) {
+	hashHeader, ok := service.GetAnnotations()[AnnotationHashHeader]
+	if !ok {
+		return "", nil, false
+	}
+
+	header, ringHash, err := parseHashHeader(hashHeader)
+	if err != nil {
+		klog.ErrorS(err, "cannot parse hash-header", "object", klog.KObj(service), "hash-header", hashHeader)
+		return "", nil, false
+	}
+	return header, ringHash, true
+}
+
+func parseHashHeader(v string) (string, *clusterv3.Cluster, error) {
+	header, params, _ := strings.Cut(v, ",")
+	// gRPC metadata keys are lowercase
+	header = strings.ToLower(strings.TrimSpace(header))
+	switch {
+	case header == "":
+		return "", nil, fmt.Errorf("no header")
+	case strings.HasPrefix(header, ":"), strings.HasSuffix(header, "-bin"):
+		// gRPC never hash these headers
+		return "", nil, fmt.Errorf("header %s cannot be hashed", header)
+	}
+
+	ringHash, err := ringHashLbPolicy(params)
+	if err != nil {
+		return "", nil, err
+	}
+	return header, ringHash, nil
+}
+
+// ringHashLbPolicy return a cluster with only the ring hash load balancing policy set
+// from the comma-separated ring_hash parameters
+func ringHashLbPolicy(params string) (*clusterv3.Cluster, error) {
+	out := &clusterv3.Cluster{}
+	policy, err := parseLbPolicy(LbPolicyRingHash+","+params, out)
+	if err != nil {
+		return nil, err
+	}
+	out.LoadBalancingPolicy, err = typedLbPolicy(policy)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
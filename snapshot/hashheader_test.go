@@ -0,0 +1,98 @@
+package snapshot
+
+import (
+	"testing"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_parseHashHeader(t *testing.T) {
+	for _, testcase := range []struct {
+		Input         string
+		ExpectHeader  string
+		ExpectMinRing uint64
+		ExpectMaxRing uint64
+		ExpectErr     bool
+	}{
+		{
+			Input:        "x-user-id",
+			ExpectHeader: "x-user-id",
+		},
+		{
+			Input:         "X-User-ID, min_ring_size=1024, max_ring_size=4096",
+			ExpectHeader:  "x-user-id",
+			ExpectMinRing: 1024,
+			ExpectMaxRing: 4096,
+		},
+		{
+			Input:     "",
+			ExpectErr: true,
+		},
+		{
+			Input:     ",min_ring_size=1024",
+			ExpectErr: true,
+		},
+		{
+			Input:     ":authority",
+			ExpectErr: true,
+		},
+		{
+			Input:     "x-token-bin",
+			ExpectErr: true,
+		},
+		{
+			Input:     "x-user-id,min_ring_size=4096,max_ring_size=1024",
+			ExpectErr: true,
+		},
+		{
+			Input:     "x-user-id,choice_count=2",
+			ExpectErr: true,
+		},
+	} {
+		t.Run(testcase.Input, func(t *testing.T) {
+			header, ringHash, err := parseHashHeader(testcase.Input)
+			if testcase.ExpectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testcase.ExpectHeader, header)
+			assert.Equal(t, clusterv3.Cluster_RING_HASH, ringHash.LbPolicy)
+			assert.Equal(t, testcase.ExpectMinRing, ringHash.GetRingHashLbConfig().GetMinimumRingSize().GetValue())
+			assert.Equal(t, testcase.ExpectMaxRing, ringHash.GetRingHashLbConfig().GetMaximumRingSize().GetValue())
+			require.NotNil(t, ringHash.LoadBalancingPolicy)
+		})
+	}
+}
+
+func Test_hashHeader(t *testing.T) {
+	service := newTestService(map[string]string{
+		AnnotationHashHeader: "x-user-id,max_ring_size=4096",
+	})
+	service.Spec.SessionAffinity = corev1.ServiceAffinityClientIP
+
+	// The header takes precedence over session affinity
+	hashPolicy := hashPolicyFromService(service)
+	require.Len(t, hashPolicy, 1)
+	assert.Equal(t, "x-user-id", hashPolicy[0].GetHeader().GetHeaderName())
+
+	cluster := &clusterv3.Cluster{LbPolicy: clusterv3.Cluster_ROUND_ROBIN}
+	applyRingHash(service, cluster)
+	assert.Equal(t, clusterv3.Cluster_RING_HASH, cluster.LbPolicy)
+	assert.Equal(t, uint64(4096), cluster.GetRingHashLbConfig().GetMaximumRingSize().GetValue())
+
+	// Invalid annotations fall back to session affinity
+	service.Annotations[AnnotationHashHeader] = "x-token-bin"
+	hashPolicy = hashPolicyFromService(service)
+	require.Len(t, hashPolicy, 1)
+	assert.Equal(t, channelIDFilterStateKey, hashPolicy[0].GetFilterState().GetKey())
+
+	service.Spec.SessionAffinity = corev1.ServiceAffinityNone
+	assert.Nil(t, hashPolicyFromService(service))
+	cluster = &clusterv3.Cluster{LbPolicy: clusterv3.Cluster_ROUND_ROBIN}
+	applyRingHash(service, cluster)
+	assert.Equal(t, clusterv3.Cluster_ROUND_ROBIN, cluster.LbPolicy)
+}
@@ -0,0 +1,121 @@
+package snapshot
+
+import (
+	"fmt"
+	"strings"
+
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	matcherv3 "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	"google.golang.org/protobuf/proto"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// AnnotationHeaderRoutes is a comma-separated list of rules that route calls with a header to another service in
+// the same namespace. Each rule is header=value->service, or header->service to match any value.
+// The service may be followed by :port to use another port name. For example, "x-canary=true->foo-canary,x-tenant=vip->foo-vip"
+const AnnotationHeaderRoutes = "xds.lmwn.com/header-routes"
+
+type headerRoute struct {
+	Header string
+	// Value is the exact value to match, or nil to match any value
+	Value   *string
+	Service string
+	// Port is the port name of the target service, or empty to use the same port name
+	Port string
+}
+
+// headerRoutesFromService convert the header routes annotation on the Kubernetes service to routes of the port,
+// which must be placed before the default route. The routes copy the rest of the default route action.
+// It may return nil if not configured, or if any target service or its port is not known
+//
+// The supported matchers are as in gRPC [A28](https://github.com/grpc/proposal/blob/master/A28-xds-traffic-splitting-and-routing.md)
+func headerRoutesFromService(service *corev1.Service, port corev1.ServicePort, services map[string]*corev1.Service, defaultAction *routev3.RouteAction) []*routev3.Route {
+	headerRoutes, ok := service.GetAnnotations()[AnnotationHeaderRoutes]
+	if !ok {
+		return nil
+	}
+
+	rules, err := parseHeaderRoutes(headerRoutes)
+	if err != nil {
+		klog.ErrorS(err, "cannot parse header-routes", "object", klog.KObj(service), "header-routes", headerRoutes)
+		return nil
+	}
+
+	out := make([]*routev3.Route, 0, len(rules))
+	for i, rule := range rules {
+		portName := rule.Port
+		if portName == "" {
+			portName = port.Name
+		}
+		cluster, err := serviceCluster(service.Namespace, rule.Service, portName, services)
+		if err != nil {
+			klog.ErrorS(err, "invalid header-routes", "object", klog.KObj(service), "header-routes", headerRoutes)
+			return nil
+		}
+
+		matcher := &routev3.HeaderMatcher{Name: rule.Header}
+		if rule.Value == nil {
+			matcher.HeaderMatchSpecifier = &routev3.HeaderMatcher_PresentMatch{PresentMatch: true}
+		} else {
+			matcher.HeaderMatchSpecifier = &routev3.HeaderMatcher_StringMatch{
+				StringMatch: &matcherv3.StringMatcher{
+					MatchPattern: &matcherv3.StringMatcher_Exact{Exact: *rule.Value},
+				},
+			}
+		}
+
+		action := proto.Clone(defaultAction).(*routev3.RouteAction)
+		action.ClusterSpecifier = &routev3.RouteAction_Cluster{Cluster: cluster}
+
+		out = append(out, &routev3.Route{
+			Name: fmt.Sprintf("header-%d", i),
+			Match: &routev3.RouteMatch{
+				PathSpecifier: &routev3.RouteMatch_Prefix{},
+				Headers:       []*routev3.HeaderMatcher{matcher},
+			},
+			Action: &routev3.Route_Route{
+				Route: action,
+			},
+		})
+	}
+	return out
+}
+
+func parseHeaderRoutes(v string) ([]headerRoute, error) {
+	var out []headerRoute
+
+	for _, entry := range strings.Split(v, ",") {
+		match, target, ok := strings.Cut(entry, "->")
+		if !ok {
+			return nil, fmt.Errorf("rule %q is not in header=value->service form", entry)
+		}
+
+		var rule headerRoute
+		header, value, hasValue := strings.Cut(match, "=")
+		// gRPC metadata keys are lowercase
+		rule.Header = strings.ToLower(strings.TrimSpace(header))
+		if hasValue {
+			value = strings.TrimSpace(value)
+			rule.Value = &value
+		}
+		switch {
+		case rule.Header == "":
+			return nil, fmt.Errorf("rule %q has no header", entry)
+		case strings.HasPrefix(rule.Header, "grpc-"), strings.HasPrefix(rule.Header, ":"), strings.HasSuffix(rule.Header, "-bin"):
+			// gRPC never match these headers
+			return nil, fmt.Errorf("header %s cannot be matched", rule.Header)
+		}
+
+		service, portName, _ := strings.Cut(strings.TrimSpace(target), ":")
+		rule.Service = strings.TrimSpace(service)
+		rule.Port = strings.TrimSpace(portName)
+		if rule.Service == "" {
+			return nil, fmt.Errorf("rule %q has no service", entry)
+		}
+
+		out = append(out, rule)
+	}
+
+	return out, nil
+}
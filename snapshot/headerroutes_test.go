@@ -0,0 +1,115 @@
+package snapshot
+
+import (
+	"testing"
+
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+)
+
+func Test_parseHeaderRoutes(t *testing.T) {
+	for _, testcase := range []struct {
+		Input     string
+		Expect    []headerRoute
+		ExpectErr bool
+	}{
+		{
+			Input: "x-canary=true->foo-canary, X-Tenant = vip -> foo-vip:http",
+			Expect: []headerRoute{
+				{Header: "x-canary", Value: ptr.To("true"), Service: "foo-canary"},
+				{Header: "x-tenant", Value: ptr.To("vip"), Service: "foo-vip", Port: "http"},
+			},
+		},
+		{
+			Input:  "x-debug->foo-debug",
+			Expect: []headerRoute{{Header: "x-debug", Service: "foo-debug"}},
+		},
+		{
+			Input:  "x-empty=->foo",
+			Expect: []headerRoute{{Header: "x-empty", Value: ptr.To(""), Service: "foo"}},
+		},
+		{
+			Input:     "",
+			ExpectErr: true,
+		},
+		{
+			Input:     "x-canary=true",
+			ExpectErr: true,
+		},
+		{
+			Input:     "=true->foo",
+			ExpectErr: true,
+		},
+		{
+			Input:     "x-canary=true->",
+			ExpectErr: true,
+		},
+		{
+			Input:     "grpc-timeout->foo",
+			ExpectErr: true,
+		},
+		{
+			Input:     "x-trace-bin->foo",
+			ExpectErr: true,
+		},
+		{
+			Input:     ":authority=foo->foo",
+			ExpectErr: true,
+		},
+	} {
+		t.Run(testcase.Input, func(t *testing.T) {
+			out, err := parseHeaderRoutes(testcase.Input)
+			if testcase.ExpectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testcase.Expect, out)
+		})
+	}
+}
+
+func Test_headerRoutesFromService(t *testing.T) {
+	services := servicesByName([]*corev1.Service{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo-canary", Namespace: "default"},
+			Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: "grpc"}, {Name: "http"}}},
+		},
+	})
+	port := corev1.ServicePort{Name: "grpc"}
+	defaultAction := &routev3.RouteAction{
+		ClusterSpecifier: &routev3.RouteAction_Cluster{Cluster: "foo.default:grpc"},
+		RetryPolicy:      &routev3.RetryPolicy{RetryOn: "unavailable"},
+	}
+	service := func(headerRoutes string) *corev1.Service {
+		return &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "foo",
+				Namespace:   "default",
+				Annotations: map[string]string{AnnotationHeaderRoutes: headerRoutes},
+			},
+		}
+	}
+
+	out := headerRoutesFromService(service("x-canary=true->foo-canary,x-debug->foo-canary:http"), port, services, defaultAction)
+	require.Len(t, out, 2)
+
+	assert.Equal(t, "x-canary", out[0].Match.Headers[0].Name)
+	assert.Equal(t, "true", out[0].Match.Headers[0].GetStringMatch().GetExact())
+	assert.Equal(t, "foo-canary.default:grpc", out[0].GetRoute().GetCluster())
+	assert.Equal(t, "unavailable", out[0].GetRoute().GetRetryPolicy().GetRetryOn())
+
+	assert.True(t, out[1].Match.Headers[0].GetPresentMatch())
+	assert.Equal(t, "foo-canary.default:http", out[1].GetRoute().GetCluster())
+
+	// The default action is not modified
+	assert.Equal(t, "foo.default:grpc", defaultAction.GetCluster())
+
+	assert.Nil(t, headerRoutesFromService(service("x-canary=true->missing"), port, services, defaultAction))
+	assert.Nil(t, headerRoutesFromService(service("x-canary=true->foo-canary:missing"), port, services, defaultAction))
+	assert.Nil(t, headerRoutesFromService(&corev1.Service{}, port, services, defaultAction))
+}
@@ -0,0 +1,245 @@
+package snapshot
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	cswrrv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/load_balancing_policies/client_side_weighted_round_robin/v3"
+	leastrequestv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/load_balancing_policies/least_request/v3"
+	pickfirstv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/load_balancing_policies/pick_first/v3"
+	ringhashv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/load_balancing_policies/ring_hash/v3"
+	roundrobinv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/load_balancing_policies/round_robin/v3"
+	wrrlocalityv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/load_balancing_policies/wrr_locality/v3"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// AnnotationLbPolicy is the load balancing policy of the service's clusters, optionally followed by
+// comma-separated key=value parameters. For example, "ring_hash,min_ring_size=1024,max_ring_size=4096"
+const AnnotationLbPolicy = "xds.lmwn.com/lb-policy"
+
+const (
+	LbPolicyRoundRobin         = "round_robin"
+	LbPolicyLeastRequest       = "least_request"
+	LbPolicyPickFirst          = "pick_first"
+	LbPolicyRingHash           = "ring_hash"
+	LbPolicyWeightedRoundRobin = "weighted_round_robin"
+)
+
+// maxRingSize is the upper bound of ring size accepted by gRPC
+const maxRingSize = 8 * 1024 * 1024
+
+// applyLbPolicy set the load balancing policy of the cluster from the annotations on the Kubernetes service.
+// The cluster is left as round robin if not configured or the annotation is invalid
+//
+// The policy is set as the typed load_balancing_policy of gRPC [A52](https://github.com/grpc/proposal/blob/master/A52-xds-custom-lb-policies.md)
+// with round robin as fallback for clients that do not support it.
+// The legacy lb_policy field is also set for clients that predate A52
+func applyLbPolicy(service *corev1.Service, cluster *clusterv3.Cluster) {
+	lbPolicy, ok := service.GetAnnotations()[AnnotationLbPolicy]
+	if !ok {
+		logUnusedWeightedRoundRobin(service)
+		return
+	}
+
+	parsed := &clusterv3.Cluster{}
+	policy, err := parseLbPolicy(lbPolicy, parsed)
+	if err == nil {
+		if weightedRoundRobin, ok := policy.(*cswrrv3.ClientSideWeightedRoundRobin); ok {
+			applyWeightedRoundRobin(service, weightedRoundRobin)
+		} else {
+			logUnusedWeightedRoundRobin(service)
+		}
+		parsed.LoadBalancingPolicy, err = typedLbPolicy(policy)
+	}
+	if err != nil {
+		klog.ErrorS(err, "cannot parse lb-policy", "object", klog.KObj(service), "lb-policy", lbPolicy)
+		return
+	}
+
+	cluster.LbPolicy = parsed.LbPolicy
+	cluster.LbConfig = parsed.LbConfig
+	cluster.LoadBalancingPolicy = parsed.LoadBalancingPolicy
+}
+
+// parseLbPolicy return the typed policy of the annotation value, and set the legacy LbPolicy and LbConfig of the cluster
+func parseLbPolicy(v string, cluster *clusterv3.Cluster) (proto.Message, error) {
+	name, rawParams, _ := strings.Cut(v, ",")
+	name = strings.TrimSpace(name)
+
+	params, err := parseParams(rawParams)
+	if err != nil {
+		return nil, err
+	}
+
+	var policy proto.Message
+	cluster.LbPolicy = clusterv3.Cluster_ROUND_ROBIN
+
+	switch name {
+	case LbPolicyRoundRobin:
+		policy = &roundrobinv3.RoundRobin{}
+	case LbPolicyPickFirst:
+		out := &pickfirstv3.PickFirst{}
+		out.ShuffleAddressList, err = takeBoolParam(params, "shuffle_address_list")
+		policy = out
+	case LbPolicyLeastRequest:
+		out := &leastrequestv3.LeastRequest{}
+		out.ChoiceCount, err = takeUint32Param(params, "choice_count")
+		if err == nil && out.ChoiceCount != nil && out.ChoiceCount.Value < 2 {
+			err = fmt.Errorf("choice_count must be at least 2")
+		}
+		cluster.LbPolicy = clusterv3.Cluster_LEAST_REQUEST
+		cluster.LbConfig = &clusterv3.Cluster_LeastRequestLbConfig_{
+			LeastRequestLbConfig: &clusterv3.Cluster_LeastRequestLbConfig{ChoiceCount: out.ChoiceCount},
+		}
+		policy = out
+	case LbPolicyRingHash:
+		out := &ringhashv3.RingHash{HashFunction: ringhashv3.RingHash_XX_HASH}
+		out.MinimumRingSize, err = takeUint64Param(params, "min_ring_size")
+		if err == nil {
+			out.MaximumRingSize, err = takeUint64Param(params, "max_ring_size")
+		}
+		if err == nil {
+			err = validateRingSize(out.MinimumRingSize, out.MaximumRingSize)
+		}
+		cluster.LbPolicy = clusterv3.Cluster_RING_HASH
+		cluster.LbConfig = &clusterv3.Cluster_RingHashLbConfig_{
+			RingHashLbConfig: &clusterv3.Cluster_RingHashLbConfig{
+				MinimumRingSize: out.MinimumRingSize,
+				MaximumRingSize: out.MaximumRingSize,
+			},
+		}
+		policy = out
+	case LbPolicyWeightedRoundRobin:
+		policy = &cswrrv3.ClientSideWeightedRoundRobin{}
+	default:
+		return nil, fmt.Errorf("unknown policy %q", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(params) > 0 {
+		return nil, fmt.Errorf("unknown parameters %v for policy %s", slices.Sorted(maps.Keys(params)), name)
+	}
+
+	return policy, nil
+}
+
+// parseParams parse comma-separated key=value parameters
+func parseParams(v string) (map[string]string, error) {
+	params := map[string]string{}
+	for _, param := range strings.Split(v, ",") {
+		if strings.TrimSpace(param) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(param, "=")
+		if !ok {
+			return nil, fmt.Errorf("parameter %q is not in key=value form", param)
+		}
+		params[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return params, nil
+}
+
+// typedLbPolicy build the load_balancing_policy of the policy with round robin as fallback.
+// Ring hash and pick first are top level as they pick from the endpoints of every locality. Other policies
+// pick endpoints within localities weighted by xds_wrr_locality, as gRPC does for the legacy lb_policy field
+func typedLbPolicy(policy proto.Message) (*clusterv3.LoadBalancingPolicy, error) {
+	switch policy.(type) {
+	case *ringhashv3.RingHash, *pickfirstv3.PickFirst:
+		return loadBalancingPolicy(policy, &roundrobinv3.RoundRobin{})
+	}
+
+	policies := []proto.Message{policy}
+	if _, ok := policy.(*roundrobinv3.RoundRobin); !ok {
+		policies = append(policies, &roundrobinv3.RoundRobin{})
+	}
+	endpointPicking, err := loadBalancingPolicy(policies...)
+	if err != nil {
+		return nil, err
+	}
+	return loadBalancingPolicy(&wrrlocalityv3.WrrLocality{
+		EndpointPickingPolicy: endpointPicking,
+	})
+}
+
+// loadBalancingPolicy build a load_balancing_policy from the policies in order of preference
+func loadBalancingPolicy(policies ...proto.Message) (*clusterv3.LoadBalancingPolicy, error) {
+	out := &clusterv3.LoadBalancingPolicy{}
+	for _, policy := range policies {
+		typedConfig, err := anypb.New(policy)
+		if err != nil {
+			return nil, err
+		}
+		out.Policies = append(out.Policies, &clusterv3.LoadBalancingPolicy_Policy{
+			TypedExtensionConfig: &corev3.TypedExtensionConfig{
+				Name:        string(policy.ProtoReflect().Descriptor().FullName()),
+				TypedConfig: typedConfig,
+			},
+		})
+	}
+	return out, nil
+}
+
+func validateRingSize(minSize *wrapperspb.UInt64Value, maxSize *wrapperspb.UInt64Value) error {
+	if minSize != nil && (minSize.Value == 0 || minSize.Value > maxRingSize) {
+		return fmt.Errorf("min_ring_size must be between 1 and %d", maxRingSize)
+	}
+	if maxSize != nil && (maxSize.Value == 0 || maxSize.Value > maxRingSize) {
+		return fmt.Errorf("max_ring_size must be between 1 and %d", maxRingSize)
+	}
+	if minSize != nil && maxSize != nil && minSize.Value > maxSize.Value {
+		return fmt.Errorf("min_ring_size must not be greater than max_ring_size")
+	}
+	return nil
+}
+
+// takeBoolParam remove the parameter from params and parse it
+func takeBoolParam(params map[string]string, key string) (bool, error) {
+	value, ok := params[key]
+	if !ok {
+		return false, nil
+	}
+	delete(params, key)
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("cannot parse %s: %w", key, err)
+	}
+	return parsed, nil
+}
+
+// takeUint32Param remove the parameter from params and parse it. It returns nil if not set
+func takeUint32Param(params map[string]string, key string) (*wrapperspb.UInt32Value, error) {
+	value, ok := params[key]
+	if !ok {
+		return nil, nil
+	}
+	delete(params, key)
+	parsed, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %w", key, err)
+	}
+	return wrapperspb.UInt32(uint32(parsed)), nil
+}
+
+// takeUint64Param remove the parameter from params and parse it. It returns nil if not set
+func takeUint64Param(params map[string]string, key string) (*wrapperspb.UInt64Value, error) {
+	value, ok := params[key]
+	if !ok {
+		return nil, nil
+	}
+	delete(params, key)
+	parsed, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %w", key, err)
+	}
+	return wrapperspb.UInt64(parsed), nil
+}
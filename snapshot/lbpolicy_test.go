@@ -0,0 +1,142 @@
+package snapshot
+
+import (
+	"testing"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	leastrequestv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/load_balancing_policies/least_request/v3"
+	pickfirstv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/load_balancing_policies/pick_first/v3"
+	ringhashv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/load_balancing_policies/ring_hash/v3"
+	wrrlocalityv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/load_balancing_policies/wrr_locality/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseLbPolicy(t *testing.T) {
+	for _, testcase := range []struct {
+		Input        string
+		ExpectLegacy clusterv3.Cluster_LbPolicy
+		ExpectTyped  string
+		ExpectErr    bool
+	}{
+		{
+			Input:        "round_robin",
+			ExpectLegacy: clusterv3.Cluster_ROUND_ROBIN,
+			ExpectTyped:  "envoy.extensions.load_balancing_policies.wrr_locality.v3.WrrLocality",
+		},
+		{
+			Input:        "least_request,choice_count=3",
+			ExpectLegacy: clusterv3.Cluster_LEAST_REQUEST,
+			ExpectTyped:  "envoy.extensions.load_balancing_policies.wrr_locality.v3.WrrLocality",
+		},
+		{
+			Input:        "pick_first, shuffle_address_list=true",
+			ExpectLegacy: clusterv3.Cluster_ROUND_ROBIN,
+			ExpectTyped:  "envoy.extensions.load_balancing_policies.pick_first.v3.PickFirst",
+		},
+		{
+			Input:        "ring_hash,min_ring_size=1024,max_ring_size=4096",
+			ExpectLegacy: clusterv3.Cluster_RING_HASH,
+			ExpectTyped:  "envoy.extensions.load_balancing_policies.ring_hash.v3.RingHash",
+		},
+		{
+			Input:        "weighted_round_robin",
+			ExpectLegacy: clusterv3.Cluster_ROUND_ROBIN,
+			ExpectTyped:  "envoy.extensions.load_balancing_policies.wrr_locality.v3.WrrLocality",
+		},
+		{
+			Input:     "",
+			ExpectErr: true,
+		},
+		{
+			Input:     "random",
+			ExpectErr: true,
+		},
+		{
+			Input:     "least_request,choice_count=1",
+			ExpectErr: true,
+		},
+		{
+			Input:     "least_request,choice_count",
+			ExpectErr: true,
+		},
+		{
+			Input:     "ring_hash,min_ring_size=4096,max_ring_size=1024",
+			ExpectErr: true,
+		},
+		{
+			Input:     "ring_hash,max_ring_size=100000000",
+			ExpectErr: true,
+		},
+		{
+			Input:     "round_robin,choice_count=3",
+			ExpectErr: true,
+		},
+	} {
+		t.Run(testcase.Input, func(t *testing.T) {
+			out := &clusterv3.Cluster{}
+			policy, err := parseLbPolicy(testcase.Input, out)
+			if testcase.ExpectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testcase.ExpectLegacy, out.LbPolicy)
+
+			typed, err := typedLbPolicy(policy)
+			require.NoError(t, err)
+			require.NotEmpty(t, typed.GetPolicies())
+			assert.Equal(t, testcase.ExpectTyped, typed.Policies[0].TypedExtensionConfig.Name)
+		})
+	}
+}
+
+func Test_typedLbPolicy(t *testing.T) {
+	out := &clusterv3.Cluster{}
+	policy, err := parseLbPolicy("least_request,choice_count=3", out)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(3), out.GetLeastRequestLbConfig().GetChoiceCount().GetValue())
+	typed, err := typedLbPolicy(policy)
+	require.NoError(t, err)
+
+	wrrLocality := &wrrlocalityv3.WrrLocality{}
+	require.NoError(t, typed.Policies[0].TypedExtensionConfig.TypedConfig.UnmarshalTo(wrrLocality))
+	endpointPicking := wrrLocality.EndpointPickingPolicy.GetPolicies()
+	require.Len(t, endpointPicking, 2)
+
+	leastRequest := &leastrequestv3.LeastRequest{}
+	require.NoError(t, endpointPicking[0].TypedExtensionConfig.TypedConfig.UnmarshalTo(leastRequest))
+	assert.Equal(t, uint32(3), leastRequest.GetChoiceCount().GetValue())
+	assert.Equal(t, "envoy.extensions.load_balancing_policies.round_robin.v3.RoundRobin", endpointPicking[1].TypedExtensionConfig.Name)
+
+	policy, err = parseLbPolicy("ring_hash,max_ring_size=4096", out)
+	require.NoError(t, err)
+	typed, err = typedLbPolicy(policy)
+	require.NoError(t, err)
+	ringHash := &ringhashv3.RingHash{}
+	require.NoError(t, typed.Policies[0].TypedExtensionConfig.TypedConfig.UnmarshalTo(ringHash))
+	assert.Equal(t, ringhashv3.RingHash_XX_HASH, ringHash.HashFunction)
+	assert.Equal(t, uint64(4096), ringHash.GetMaximumRingSize().GetValue())
+
+	// Pick first is not wrapped by wrr_locality, so that it picks the first endpoint of every locality
+	policy, err = parseLbPolicy("pick_first,shuffle_address_list=true", out)
+	require.NoError(t, err)
+	typed, err = typedLbPolicy(policy)
+	require.NoError(t, err)
+	require.Len(t, typed.Policies, 2)
+	pickFirst := &pickfirstv3.PickFirst{}
+	require.NoError(t, typed.Policies[0].TypedExtensionConfig.TypedConfig.UnmarshalTo(pickFirst))
+	assert.True(t, pickFirst.ShuffleAddressList)
+	assert.Equal(t, "envoy.extensions.load_balancing_policies.round_robin.v3.RoundRobin", typed.Policies[1].TypedExtensionConfig.Name)
+}
+
+func Test_applyLbPolicy_invalid(t *testing.T) {
+	cluster := &clusterv3.Cluster{LbPolicy: clusterv3.Cluster_ROUND_ROBIN}
+	applyLbPolicy(newTestService(map[string]string{
+		AnnotationLbPolicy: "ring_hash,min_ring_size=abc",
+	}), cluster)
+
+	assert.Equal(t, clusterv3.Cluster_ROUND_ROBIN, cluster.LbPolicy)
+	assert.Nil(t, cluster.LbConfig)
+	assert.Nil(t, cluster.LoadBalancingPolicy)
+}
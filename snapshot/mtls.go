@@ -0,0 +1,190 @@
+package snapshot
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	matcherv3 "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// AnnotationMTLS enable or disable mTLS of the service with "true" or "false",
+// overriding the namespaces of MTLS
+const AnnotationMTLS = "xds.lmwn.com/mtls"
+
+// AnnotationMTLSServiceAccounts is a comma-separated list of ServiceAccounts in the service's namespace
+// that the service's certificate may identify as
+const AnnotationMTLSServiceAccounts = "xds.lmwn.com/mtls-service-accounts"
+
+// AnnotationMTLSSpiffeIDs is a comma-separated list of SPIFFE IDs that the service's certificate may identify as
+const AnnotationMTLSSpiffeIDs = "xds.lmwn.com/mtls-spiffe-ids"
+
+const defaultTrustDomain = "cluster.local"
+const defaultCertificateProvider = "default"
+
+// MTLS configures mutual TLS between xDS clients and services
+type MTLS struct {
+	// Namespaces where every Service use mTLS, unless disabled by annotation
+	Namespaces []string `json:"namespaces,omitempty"`
+	// TrustDomain of the SPIFFE IDs of ServiceAccounts. Default to cluster.local
+	TrustDomain string `json:"trustDomain,omitempty"`
+	// CertificateProvider is the certificate provider instance in the clients' bootstrap
+	// that provide both the identity and the root certificates. Default to "default"
+	CertificateProvider string `json:"certificateProvider,omitempty"`
+}
+
+func (m MTLS) trustDomain() string {
+	if m.TrustDomain == "" {
+		return defaultTrustDomain
+	}
+	return m.TrustDomain
+}
+
+func (m MTLS) certificateProvider() string {
+	if m.CertificateProvider == "" {
+		return defaultCertificateProvider
+	}
+	return m.CertificateProvider
+}
+
+// isEnabled return whether calls to the service use mTLS.
+// External services only use mTLS if enabled by annotation
+func (m MTLS) isEnabled(service *corev1.Service) bool {
+	enabled := slices.Contains(m.Namespaces, service.Namespace) && !isExternal(service)
+
+	value, ok := service.GetAnnotations()[AnnotationMTLS]
+	if ok {
+		parsed, err := strconv.ParseBool(value)
+		if err == nil {
+			enabled = parsed
+		} else {
+			klog.ErrorS(err, "cannot parse mtls", "object", klog.KObj(service), "mtls", value)
+		}
+	}
+
+	return enabled
+}
+
+// transportSocketFromService return the TLS transport socket of the service's clusters
+// It may return nil if mTLS is not enabled for the service
+//
+// The certificates are read by the clients from the certificate provider in their bootstrap as in gRPC
+// [A29](https://github.com/grpc/proposal/blob/master/A29-xds-tls-security.md). The service's certificate must
+// identify as one of its ServiceAccounts or SPIFFE IDs, or as any ServiceAccount in its namespace if neither is set
+func (m MTLS) transportSocketFromService(service *corev1.Service) *corev3.TransportSocket {
+	if !m.isEnabled(service) {
+		return nil
+	}
+
+	certificateProvider := &tlsv3.CertificateProviderPluginInstance{
+		InstanceName: m.certificateProvider(),
+	}
+	tlsContext, _ := anypb.New(&tlsv3.UpstreamTlsContext{
+		CommonTlsContext: &tlsv3.CommonTlsContext{
+			TlsCertificateProviderInstance: certificateProvider,
+			ValidationContextType: &tlsv3.CommonTlsContext_ValidationContext{
+				ValidationContext: &tlsv3.CertificateValidationContext{
+					CaCertificateProviderInstance: certificateProvider,
+					MatchSubjectAltNames:          m.subjectAltNameMatchers(service),
+				},
+			},
+		},
+	})
+
+	return &corev3.TransportSocket{
+		Name: wellknown.TransportSocketTLS,
+		ConfigType: &corev3.TransportSocket_TypedConfig{
+			TypedConfig: tlsContext,
+		},
+	}
+}
+
+// serverTransportSocketFromService return the TLS transport socket of the server listeners of the service,
+// which require client certificates issued by the same CA. It may return nil if mTLS is not enabled for the service
+func (m MTLS) serverTransportSocketFromService(service *corev1.Service) *corev3.TransportSocket {
+	if !m.isEnabled(service) {
+		return nil
+	}
+
+	certificateProvider := &tlsv3.CertificateProviderPluginInstance{
+		InstanceName: m.certificateProvider(),
+	}
+	tlsContext, _ := anypb.New(&tlsv3.DownstreamTlsContext{
+		RequireClientCertificate: wrapperspb.Bool(true),
+		CommonTlsContext: &tlsv3.CommonTlsContext{
+			TlsCertificateProviderInstance: certificateProvider,
+			ValidationContextType: &tlsv3.CommonTlsContext_ValidationContext{
+				ValidationContext: &tlsv3.CertificateValidationContext{
+					CaCertificateProviderInstance: certificateProvider,
+				},
+			},
+		},
+	})
+
+	return &corev3.TransportSocket{
+		Name: wellknown.TransportSocketTLS,
+		ConfigType: &corev3.TransportSocket_TypedConfig{
+			TypedConfig: tlsContext,
+		},
+	}
+}
+
+func (m MTLS) subjectAltNameMatchers(service *corev1.Service) []*matcherv3.StringMatcher {
+	annotations := service.GetAnnotations()
+	var out []*matcherv3.StringMatcher
+
+	for _, serviceAccount := range splitAnnotationList(annotations[AnnotationMTLSServiceAccounts]) {
+		out = append(out, &matcherv3.StringMatcher{
+			MatchPattern: &matcherv3.StringMatcher_Exact{
+				Exact: m.spiffeID(service.Namespace, serviceAccount),
+			},
+		})
+	}
+
+	for _, spiffeID := range splitAnnotationList(annotations[AnnotationMTLSSpiffeIDs]) {
+		if !strings.HasPrefix(spiffeID, "spiffe://") {
+			klog.ErrorS(fmt.Errorf("%q is not a SPIFFE ID", spiffeID), "invalid mtls-spiffe-ids", "object", klog.KObj(service))
+			continue
+		}
+		out = append(out, &matcherv3.StringMatcher{
+			MatchPattern: &matcherv3.StringMatcher_Exact{
+				Exact: spiffeID,
+			},
+		})
+	}
+
+	if len(out) == 0 {
+		out = append(out, &matcherv3.StringMatcher{
+			MatchPattern: &matcherv3.StringMatcher_Prefix{
+				Prefix: m.spiffeID(service.Namespace, ""),
+			},
+		})
+	}
+
+	return out
+}
+
+// spiffeID return the SPIFFE ID of the ServiceAccount as issued by Istio and SPIRE's Kubernetes workload registrar
+func (m MTLS) spiffeID(namespace string, serviceAccount string) string {
+	return fmt.Sprintf("spiffe://%s/ns/%s/sa/%s", m.trustDomain(), namespace, serviceAccount)
+}
+
+// splitAnnotationList split comma-separated annotation value, ignoring empty items
+func splitAnnotationList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -0,0 +1,66 @@
+package snapshot
+
+import (
+	"testing"
+
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestMTLS_isEnabled(t *testing.T) {
+	mtls := MTLS{Namespaces: []string{"secure"}}
+	newService := func(namespace string, annotations map[string]string) *corev1.Service {
+		out := newTestService(annotations)
+		out.Namespace = namespace
+		return out
+	}
+
+	assert.True(t, mtls.isEnabled(newService("secure", nil)))
+	assert.False(t, mtls.isEnabled(newService("default", nil)))
+	assert.True(t, mtls.isEnabled(newService("default", map[string]string{AnnotationMTLS: "true"})))
+	assert.False(t, mtls.isEnabled(newService("secure", map[string]string{AnnotationMTLS: "false"})))
+	assert.True(t, mtls.isEnabled(newService("secure", map[string]string{AnnotationMTLS: "invalid"})))
+
+	// External services are not in the mesh
+	assert.False(t, mtls.isEnabled(newService("secure", map[string]string{AnnotationExternalName: "api.example.com"})))
+	assert.True(t, mtls.isEnabled(newService("secure", map[string]string{AnnotationExternalName: "api.example.com", AnnotationMTLS: "true"})))
+}
+
+func TestMTLS_transportSocketFromService(t *testing.T) {
+	upstreamTLSContext := func(t *testing.T, mtls MTLS, annotations map[string]string) *tlsv3.UpstreamTlsContext {
+		t.Helper()
+		annotations[AnnotationMTLS] = "true"
+		socket := mtls.transportSocketFromService(newTestService(annotations))
+		require.NotNil(t, socket)
+		assert.Equal(t, "envoy.transport_sockets.tls", socket.Name)
+
+		out := &tlsv3.UpstreamTlsContext{}
+		require.NoError(t, socket.GetTypedConfig().UnmarshalTo(out))
+		return out
+	}
+
+	out := upstreamTLSContext(t, MTLS{}, map[string]string{})
+	common := out.GetCommonTlsContext()
+	assert.Equal(t, "default", common.GetTlsCertificateProviderInstance().GetInstanceName())
+	assert.Equal(t, "default", common.GetValidationContext().GetCaCertificateProviderInstance().GetInstanceName())
+	require.Len(t, common.GetValidationContext().GetMatchSubjectAltNames(), 1)
+	assert.Equal(t, "spiffe://cluster.local/ns/default/sa/", common.GetValidationContext().GetMatchSubjectAltNames()[0].GetPrefix())
+
+	out = upstreamTLSContext(t, MTLS{TrustDomain: "example.com", CertificateProvider: "spiffe"}, map[string]string{
+		AnnotationMTLSServiceAccounts: "app, app-canary",
+		AnnotationMTLSSpiffeIDs:       "spiffe://other.com/app,invalid",
+	})
+	common = out.GetCommonTlsContext()
+	assert.Equal(t, "spiffe", common.GetTlsCertificateProviderInstance().GetInstanceName())
+	var sans []string
+	for _, matcher := range common.GetValidationContext().GetMatchSubjectAltNames() {
+		sans = append(sans, matcher.GetExact())
+	}
+	assert.Equal(t, []string{
+		"spiffe://example.com/ns/default/sa/app",
+		"spiffe://example.com/ns/default/sa/app-canary",
+		"spiffe://other.com/app",
+	}, sans)
+}
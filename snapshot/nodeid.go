@@ -1,12 +1,67 @@
 package snapshot
 
 import (
+	"strings"
+
 	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 )
 
-// EmptyNodeID satisfies cachev3.NodeHash but always return empty string
-type EmptyNodeID struct{}
+// NodeMetadataNamespace is the node metadata field declaring the client's Kubernetes namespace
+const NodeMetadataNamespace = "xds.lmwn.com/namespace"
+
+// NodeMetadataVisibilityGroup is the node metadata field declaring the client's visibility group.
+// It takes precedence over NodeMetadataNamespace
+const NodeMetadataVisibilityGroup = "xds.lmwn.com/visibility-group"
+
+// GlobalNodeGroup is the group of nodes that do not declare any metadata. They can see every service
+const GlobalNodeGroup = ""
+
+// NodeGroup satisfies cachev3.NodeHash. It hashes nodes to their visibility group as declared in the node metadata
+//
+// The ID is either
+// - "group/<name>" for nodes with NodeMetadataVisibilityGroup
+// - "namespace/<name>" for nodes with NodeMetadataNamespace
+// - GlobalNodeGroup for other nodes
+type NodeGroup struct{}
+
+func (n NodeGroup) ID(node *corev3.Node) string {
+	return nodeGroupFromMetadata(node).ID()
+}
+
+// nodeGroup is the parsed form of NodeGroup ID
+type nodeGroup struct {
+	Group     string
+	Namespace string
+}
+
+func nodeGroupFromMetadata(node *corev3.Node) nodeGroup {
+	fields := node.GetMetadata().GetFields()
+	if group := fields[NodeMetadataVisibilityGroup].GetStringValue(); group != "" {
+		return nodeGroup{Group: group}
+	}
+	if namespace := fields[NodeMetadataNamespace].GetStringValue(); namespace != "" {
+		return nodeGroup{Namespace: namespace}
+	}
+	return nodeGroup{}
+}
+
+func nodeGroupFromID(id string) nodeGroup {
+	if group, ok := strings.CutPrefix(id, "group/"); ok {
+		return nodeGroup{Group: group}
+	}
+	if namespace, ok := strings.CutPrefix(id, "namespace/"); ok {
+		return nodeGroup{Namespace: namespace}
+	}
+	return nodeGroup{}
+}
 
-func (e EmptyNodeID) ID(node *corev3.Node) string {
-	return ""
+func (n nodeGroup) ID() string {
+	switch {
+	case n.Group != "":
+		return "group/" + n.Group
+	case n.Namespace != "":
+		return "namespace/" + n.Namespace
+	default:
+		return GlobalNodeGroup
+	}
 }
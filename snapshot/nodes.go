@@ -0,0 +1,100 @@
+package snapshot
+
+import (
+	"context"
+	"maps"
+
+	"github.com/wongnai/xds/meter"
+	"go.opentelemetry.io/otel/metric"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	k8scache "k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// LabelTopologySubzone is the node label used as locality sub-zone.
+// Unlike region and zone, Kubernetes does not define a well-known label for this
+const LabelTopologySubzone = "topology.kubernetes.io/subzone"
+
+// locality is the topology of a Kubernetes node, as used in xDS locality
+type locality struct {
+	Region  string
+	Zone    string
+	SubZone string
+}
+
+func (s *Snapshotter) startNodes(ctx context.Context) error {
+	store := k8scache.NewUndeltaStore(func(v []interface{}) {
+		s.kubeEventCounter.Add(ctx, 1, metric.WithAttributes(meter.ResourceAttrKey.String("nodes")))
+
+		topology := kubeNodesToTopology(sliceToNodes(v))
+		if !s.setNodeTopology(topology) {
+			return
+		}
+
+		klog.V(4).InfoS("node topology changed, refreshing endpoints", "nodes", len(topology))
+		s.refreshEndpoints()
+	}, k8scache.DeletionHandlingMetaNamespaceKeyFunc)
+
+	reflector := k8scache.NewReflector(&k8scache.ListWatch{
+		ListWithContextFunc: func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+			return s.client.CoreV1().Nodes().List(ctx, options)
+		},
+		WatchFuncWithContext: func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
+			return s.client.CoreV1().Nodes().Watch(ctx, options)
+		},
+	}, &corev1.Node{}, store, s.ResyncPeriod)
+
+	reflector.Run(ctx.Done())
+	return nil
+}
+
+func sliceToNodes(s []interface{}) []*corev1.Node {
+	out := make([]*corev1.Node, len(s))
+	for i, v := range s {
+		out[i] = v.(*corev1.Node)
+	}
+	return out
+}
+
+// kubeNodesToTopology map node name to its locality. Nodes without any topology labels are omitted
+func kubeNodesToTopology(nodes []*corev1.Node) map[string]locality {
+	out := make(map[string]locality, len(nodes))
+	for _, node := range nodes {
+		l := locality{
+			Region:  node.Labels[corev1.LabelTopologyRegion],
+			Zone:    node.Labels[corev1.LabelTopologyZone],
+			SubZone: node.Labels[LabelTopologySubzone],
+		}
+		if l == (locality{}) {
+			continue
+		}
+		out[node.Name] = l
+	}
+	return out
+}
+
+// setNodeTopology replace the node topology and return whether it has changed
+func (s *Snapshotter) setNodeTopology(topology map[string]locality) bool {
+	s.nodeTopologyLock.Lock()
+	defer s.nodeTopologyLock.Unlock()
+	if maps.Equal(s.nodeTopology, topology) {
+		return false
+	}
+	s.nodeTopology = topology
+	return true
+}
+
+// endpointLocality return the locality of the endpoint. The zone reported by the EndpointSlice take precedence over the node's labels
+func (s *Snapshotter) endpointLocality(addr endpointAddress) locality {
+	s.nodeTopologyLock.RLock()
+	out := s.nodeTopology[addr.NodeName]
+	s.nodeTopologyLock.RUnlock()
+
+	if addr.Zone != "" {
+		out.Zone = addr.Zone
+	}
+	return out
+}
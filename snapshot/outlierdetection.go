@@ -0,0 +1,196 @@
+package snapshot
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const AnnotationOutlierSuccessRate = "xds.lmwn.com/outlier-success-rate"
+const AnnotationOutlierFailurePercentage = "xds.lmwn.com/outlier-failure-percentage"
+const AnnotationOutlierInterval = "xds.lmwn.com/outlier-interval"
+const AnnotationOutlierBaseEjectionTime = "xds.lmwn.com/outlier-base-ejection-time"
+const AnnotationOutlierMaxEjectionTime = "xds.lmwn.com/outlier-max-ejection-time"
+const AnnotationOutlierMaxEjectionPercent = "xds.lmwn.com/outlier-max-ejection-percent"
+
+// outlierDetectionFromService convert annotations on the Kubernetes service to xDS outlier detection
+// It may return nil if neither success rate nor failure percentage ejection is configured
+//
+// The supported values are as in gRPC [A50](https://github.com/grpc/proposal/blob/master/A50-xds-outlier-detection.md)
+func outlierDetectionFromService(service *corev1.Service) *clusterv3.OutlierDetection {
+	annotations := service.GetAnnotations()
+
+	out := &clusterv3.OutlierDetection{
+		// gRPC enable success rate ejection by default. Here each algorithm is only enabled by its annotation
+		EnforcingSuccessRate:       wrapperspb.UInt32(0),
+		EnforcingFailurePercentage: wrapperspb.UInt32(0),
+	}
+	enabled := false
+
+	successRate, ok := annotations[AnnotationOutlierSuccessRate]
+	if ok {
+		parsed := &clusterv3.OutlierDetection{}
+		err := parseOutlierSuccessRate(successRate, parsed)
+		if err == nil {
+			out.SuccessRateStdevFactor = parsed.SuccessRateStdevFactor
+			out.EnforcingSuccessRate = parsed.EnforcingSuccessRate
+			out.SuccessRateMinimumHosts = parsed.SuccessRateMinimumHosts
+			out.SuccessRateRequestVolume = parsed.SuccessRateRequestVolume
+			enabled = true
+		} else {
+			klog.ErrorS(err, "cannot parse outlier-success-rate", "object", klog.KObj(service), "outlier-success-rate", successRate)
+		}
+	}
+
+	failurePercentage, ok := annotations[AnnotationOutlierFailurePercentage]
+	if ok {
+		parsed := &clusterv3.OutlierDetection{}
+		err := parseOutlierFailurePercentage(failurePercentage, parsed)
+		if err == nil {
+			out.FailurePercentageThreshold = parsed.FailurePercentageThreshold
+			out.EnforcingFailurePercentage = parsed.EnforcingFailurePercentage
+			out.FailurePercentageMinimumHosts = parsed.FailurePercentageMinimumHosts
+			out.FailurePercentageRequestVolume = parsed.FailurePercentageRequestVolume
+			enabled = true
+		} else {
+			klog.ErrorS(err, "cannot parse outlier-failure-percentage", "object", klog.KObj(service), "outlier-failure-percentage", failurePercentage)
+		}
+	}
+
+	if !enabled {
+		return nil
+	}
+
+	durations := []struct {
+		annotation string
+		target     **durationpb.Duration
+	}{
+		{AnnotationOutlierInterval, &out.Interval},
+		{AnnotationOutlierBaseEjectionTime, &out.BaseEjectionTime},
+		{AnnotationOutlierMaxEjectionTime, &out.MaxEjectionTime},
+	}
+	for _, duration := range durations {
+		value, ok := annotations[duration.annotation]
+		if !ok {
+			continue
+		}
+		parsed, err := parseNonNegativeDuration(value)
+		if err != nil {
+			klog.ErrorS(err, "cannot parse duration", "object", klog.KObj(service), "annotation", duration.annotation, "value", value)
+			continue
+		}
+		*duration.target = durationpb.New(parsed)
+	}
+
+	maxEjectionPercent, ok := annotations[AnnotationOutlierMaxEjectionPercent]
+	if ok {
+		parsed, err := parsePercent(maxEjectionPercent)
+		if err == nil {
+			out.MaxEjectionPercent = wrapperspb.UInt32(parsed)
+		} else {
+			klog.ErrorS(err, "cannot parse outlier-max-ejection-percent", "object", klog.KObj(service), "outlier-max-ejection-percent", maxEjectionPercent)
+		}
+	}
+
+	return out
+}
+
+// parseOutlierSuccessRate parse comma-separated parameters of success rate ejection into out
+func parseOutlierSuccessRate(v string, out *clusterv3.OutlierDetection) error {
+	params, err := parseParams(v)
+	if err != nil {
+		return err
+	}
+
+	out.SuccessRateStdevFactor, err = takeUint32Param(params, "stdev_factor")
+	if err != nil {
+		return err
+	}
+	enforcement, err := takePercentParam(params, "enforcement_percentage")
+	if err != nil {
+		return err
+	}
+	out.EnforcingSuccessRate = enforcement
+	if out.EnforcingSuccessRate == nil {
+		out.EnforcingSuccessRate = wrapperspb.UInt32(100)
+	}
+	out.SuccessRateMinimumHosts, err = takeUint32Param(params, "minimum_hosts")
+	if err != nil {
+		return err
+	}
+	out.SuccessRateRequestVolume, err = takeUint32Param(params, "request_volume")
+	if err != nil {
+		return err
+	}
+
+	if len(params) > 0 {
+		return fmt.Errorf("unknown parameters %v", slices.Sorted(maps.Keys(params)))
+	}
+	return nil
+}
+
+// parseOutlierFailurePercentage parse comma-separated parameters of failure percentage ejection into out
+func parseOutlierFailurePercentage(v string, out *clusterv3.OutlierDetection) error {
+	params, err := parseParams(v)
+	if err != nil {
+		return err
+	}
+
+	out.FailurePercentageThreshold, err = takePercentParam(params, "threshold")
+	if err != nil {
+		return err
+	}
+	enforcement, err := takePercentParam(params, "enforcement_percentage")
+	if err != nil {
+		return err
+	}
+	out.EnforcingFailurePercentage = enforcement
+	if out.EnforcingFailurePercentage == nil {
+		out.EnforcingFailurePercentage = wrapperspb.UInt32(100)
+	}
+	out.FailurePercentageMinimumHosts, err = takeUint32Param(params, "minimum_hosts")
+	if err != nil {
+		return err
+	}
+	out.FailurePercentageRequestVolume, err = takeUint32Param(params, "request_volume")
+	if err != nil {
+		return err
+	}
+
+	if len(params) > 0 {
+		return fmt.Errorf("unknown parameters %v", slices.Sorted(maps.Keys(params)))
+	}
+	return nil
+}
+
+func parsePercent(v string) (uint32, error) {
+	parsed, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	if parsed > 100 {
+		return 0, fmt.Errorf("percentage must be at most 100")
+	}
+	return uint32(parsed), nil
+}
+
+// takePercentParam remove the parameter from params and parse it as percentage. It returns nil if not set
+func takePercentParam(params map[string]string, key string) (*wrapperspb.UInt32Value, error) {
+	value, ok := params[key]
+	if !ok {
+		return nil, nil
+	}
+	delete(params, key)
+	parsed, err := parsePercent(value)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %w", key, err)
+	}
+	return wrapperspb.UInt32(parsed), nil
+}
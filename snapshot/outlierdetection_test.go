@@ -0,0 +1,70 @@
+package snapshot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_outlierDetectionFromService(t *testing.T) {
+	t.Run("not configured", func(t *testing.T) {
+		assert.Nil(t, outlierDetectionFromService(newTestService(map[string]string{
+			AnnotationOutlierInterval: "10s",
+		})))
+	})
+
+	t.Run("success rate", func(t *testing.T) {
+		out := outlierDetectionFromService(newTestService(map[string]string{
+			AnnotationOutlierSuccessRate:        "stdev_factor=1900,minimum_hosts=3,request_volume=50",
+			AnnotationOutlierInterval:           "5s",
+			AnnotationOutlierBaseEjectionTime:   "invalid",
+			AnnotationOutlierMaxEjectionPercent: "50",
+		}))
+		require.NotNil(t, out)
+		assert.Equal(t, uint32(1900), out.SuccessRateStdevFactor.GetValue())
+		assert.Equal(t, uint32(100), out.EnforcingSuccessRate.GetValue())
+		assert.Equal(t, uint32(3), out.SuccessRateMinimumHosts.GetValue())
+		assert.Equal(t, uint32(50), out.SuccessRateRequestVolume.GetValue())
+		assert.Equal(t, uint32(0), out.EnforcingFailurePercentage.GetValue())
+		assert.Equal(t, 5*time.Second, out.Interval.AsDuration())
+		assert.Nil(t, out.BaseEjectionTime)
+		assert.Equal(t, uint32(50), out.MaxEjectionPercent.GetValue())
+	})
+
+	t.Run("failure percentage", func(t *testing.T) {
+		out := outlierDetectionFromService(newTestService(map[string]string{
+			AnnotationOutlierFailurePercentage: "",
+			AnnotationOutlierSuccessRate:       "stdev_factor=abc",
+		}))
+		require.NotNil(t, out)
+		assert.Equal(t, uint32(0), out.EnforcingSuccessRate.GetValue())
+		assert.Equal(t, uint32(100), out.EnforcingFailurePercentage.GetValue())
+		assert.Nil(t, out.FailurePercentageThreshold)
+	})
+
+	t.Run("partially invalid", func(t *testing.T) {
+		out := outlierDetectionFromService(newTestService(map[string]string{
+			AnnotationOutlierSuccessRate:       "stdev_factor=1900",
+			AnnotationOutlierFailurePercentage: "threshold=50,minimum_hosts=3,request_volume=abc",
+		}))
+		require.NotNil(t, out)
+		assert.Equal(t, uint32(1900), out.SuccessRateStdevFactor.GetValue())
+		assert.Equal(t, uint32(100), out.EnforcingSuccessRate.GetValue())
+		// Parameters parsed before the invalid one are not used either
+		assert.Equal(t, uint32(0), out.EnforcingFailurePercentage.GetValue())
+		assert.Nil(t, out.FailurePercentageThreshold)
+		assert.Nil(t, out.FailurePercentageMinimumHosts)
+		assert.Nil(t, out.FailurePercentageRequestVolume)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		assert.Nil(t, outlierDetectionFromService(newTestService(map[string]string{
+			AnnotationOutlierFailurePercentage: "threshold=101",
+		})))
+		assert.Nil(t, outlierDetectionFromService(newTestService(map[string]string{
+			AnnotationOutlierFailurePercentage: "unknown=1",
+		})))
+	})
+}
@@ -0,0 +1,96 @@
+package snapshot
+
+import (
+	"maps"
+	"slices"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// podServiceIgnoredAnnotations are annotations of the headless service that do not apply to its pods,
+// as they would send calls to other services
+var podServiceIgnoredAnnotations = []string{
+	AnnotationTrafficSplit,
+	AnnotationHeaderRoutes,
+	AnnotationFailover,
+	AnnotationExternalName,
+	AnnotationAddressMode,
+}
+
+// podServiceCacheItem is the resources of the pod services of a headless service,
+// reused while the service and the hostnames of its pods are unchanged
+type podServiceCacheItem struct {
+	service   *corev1.Service
+	hostnames []string
+	resources []types.Resource
+}
+
+// podServiceResources return the resources of the pod services of the headless services. The resources of a headless service's pods
+// are only rebuilt when the service or the hostnames of its pods change, so that they are not hashed again
+// on every endpoints change
+// s.groupsLock must be held
+func (s *Snapshotter) podServiceResources(services []*corev1.Service) []types.Resource {
+	if s.podServiceCache == nil {
+		s.podServiceCache = map[string]podServiceCacheItem{}
+	}
+
+	var out []types.Resource
+	for _, svc := range services {
+		hostnames := s.podHostnames(svc)
+		if len(hostnames) == 0 {
+			continue
+		}
+		name := svc.Namespace + "/" + svc.Name
+		item, ok := s.podServiceCache[name]
+		if !ok || item.service != svc || !slices.Equal(item.hostnames, hostnames) {
+			item = podServiceCacheItem{
+				service:   svc,
+				hostnames: hostnames,
+				resources: kubeServicesToResources(podServicesOf(svc, hostnames), s.mtls),
+			}
+			s.podServiceCache[name] = item
+		}
+		out = append(out, item.resources...)
+	}
+	return out
+}
+
+// podHostnames return the sorted hostnames of the pods of the headless service
+// s.groupsLock must be held
+func (s *Snapshotter) podHostnames(svc *corev1.Service) []string {
+	if svc.Spec.ClusterIP != corev1.ClusterIPNone {
+		return nil
+	}
+	ep, ok := s.serviceEndpoints[svc.Namespace+"/"+svc.Name]
+	if !ok {
+		return nil
+	}
+
+	hostnames := map[string]struct{}{}
+	for _, addresses := range ep.Ports {
+		for _, addr := range addresses {
+			if addr.Hostname != "" {
+				hostnames[addr.Hostname] = struct{}{}
+			}
+		}
+	}
+	return slices.Sorted(maps.Keys(hostnames))
+}
+
+// podServicesOf return a Service named <hostname>.<service> for each pod hostname of the headless service,
+// such as StatefulSet pods. Their resources are built like other services, so that a pod can be called as
+// xds:///<hostname>.<service>.<namespace>:<port> with the same policies as its service.
+// The endpoints of the pod are built by serviceEndpointToResources once the service is known to be headless
+func podServicesOf(svc *corev1.Service, hostnames []string) []*corev1.Service {
+	out := make([]*corev1.Service, 0, len(hostnames))
+	for _, hostname := range hostnames {
+		podService := svc.DeepCopy()
+		podService.Name = hostname + "." + svc.Name
+		for _, annotation := range podServiceIgnoredAnnotations {
+			delete(podService.Annotations, annotation)
+		}
+		out = append(out, podService)
+	}
+	return out
+}
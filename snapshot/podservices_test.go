@@ -0,0 +1,118 @@
+package snapshot
+
+import (
+	"slices"
+	"testing"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestSnapshotter_podServices(t *testing.T) {
+	endpoints := &serviceEndpoints{
+		Name:      "db",
+		Namespace: "default",
+		Version:   "1",
+		Ports: map[string][]endpointAddress{
+			"grpc": {
+				{IP: "10.0.0.2", Port: 5000, Hostname: "db-1", HealthStatus: corev3.HealthStatus_HEALTHY},
+				{IP: "10.0.0.1", Port: 5000, Hostname: "db-0", HealthStatus: corev3.HealthStatus_HEALTHY},
+				{IP: "10.0.0.3", Port: 5000, HealthStatus: corev3.HealthStatus_HEALTHY},
+			},
+			"admin": {
+				{IP: "10.0.0.1", Port: 5001, Hostname: "db-0", HealthStatus: corev3.HealthStatus_HEALTHY},
+			},
+		},
+	}
+	s := &Snapshotter{
+		serviceEndpoints: map[string]*serviceEndpoints{
+			"default/db":  endpoints,
+			"default/app": {Name: "app", Namespace: "default", Ports: endpoints.Ports},
+		},
+	}
+
+	newService := func(name string, clusterIP string) *corev1.Service {
+		out := newTestService(map[string]string{
+			AnnotationTimeout:      "1s",
+			AnnotationTrafficSplit: "other=1",
+		})
+		out.Name = name
+		out.Spec.ClusterIP = clusterIP
+		return out
+	}
+
+	db := newService("db", corev1.ClusterIPNone)
+	// Only headless services have pod services
+	assert.Empty(t, s.podHostnames(newService("app", "10.96.0.10")))
+
+	out := podServicesOf(db, s.podHostnames(db))
+	require.Len(t, out, 2)
+	assert.Equal(t, "db-0.db", out[0].Name)
+	assert.Equal(t, "db-1.db", out[1].Name)
+	assert.Equal(t, "default", out[0].Namespace)
+	assert.Equal(t, map[string]string{AnnotationTimeout: "1s"}, out[0].Annotations)
+
+	// Only pods of headless services have a ClusterLoadAssignment of their own
+	resources := s.serviceEndpointsToResources([]*serviceEndpoints{endpoints})["default/db"]
+	assert.Equal(t, []string{"db.default:admin", "db.default:grpc"}, claNames(resources))
+
+	assert.True(t, s.setHeadlessServices([]*corev1.Service{db, newService("app", "10.96.0.10")}))
+	assert.False(t, s.setHeadlessServices([]*corev1.Service{db}))
+	s.endpointResourceCache = map[string]endpointCacheItem{}
+	resources = s.serviceEndpointsToResources([]*serviceEndpoints{endpoints})["default/db"]
+	assert.Equal(t, []string{
+		"db.default:admin",
+		"db-0.db.default:admin",
+		"db.default:grpc",
+		"db-0.db.default:grpc",
+		"db-1.db.default:grpc",
+	}, claNames(resources))
+
+	cla := resources[3].(*endpointv3.ClusterLoadAssignment)
+	require.Len(t, cla.Endpoints, 1)
+	require.Len(t, cla.Endpoints[0].LbEndpoints, 1)
+	assert.Equal(t, "10.0.0.1", cla.Endpoints[0].LbEndpoints[0].GetEndpoint().GetAddress().GetSocketAddress().GetAddress())
+}
+
+func TestSnapshotter_podServiceResources(t *testing.T) {
+	ports := map[string][]endpointAddress{
+		"grpc": {{IP: "10.0.0.1", Port: 5000, Hostname: "db-0", HealthStatus: corev3.HealthStatus_HEALTHY}},
+	}
+	s := &Snapshotter{
+		serviceEndpoints: map[string]*serviceEndpoints{
+			"default/db": {Name: "db", Namespace: "default", Version: "1", Ports: ports},
+		},
+	}
+	db := newTestService(nil)
+	db.Name = "db"
+	db.Spec = corev1.ServiceSpec{
+		ClusterIP: corev1.ClusterIPNone,
+		Ports:     []corev1.ServicePort{{Name: "grpc", Port: 5000}},
+	}
+
+	out := s.podServiceResources([]*corev1.Service{db})
+	require.Len(t, out, 3)
+
+	// Resources are reused while the hostnames are unchanged, so that they are not hashed again
+	s.serviceEndpoints["default/db"] = &serviceEndpoints{Name: "db", Namespace: "default", Version: "2", Ports: ports}
+	assert.Same(t, out[0], s.podServiceResources([]*corev1.Service{db})[0])
+
+	s.serviceEndpoints["default/db"] = &serviceEndpoints{Name: "db", Namespace: "default", Version: "3", Ports: map[string][]endpointAddress{
+		"grpc": append(slices.Clone(ports["grpc"]), endpointAddress{IP: "10.0.0.2", Port: 5000, Hostname: "db-1", HealthStatus: corev3.HealthStatus_HEALTHY}),
+	}}
+	changed := s.podServiceResources([]*corev1.Service{db})
+	assert.Len(t, changed, 6)
+	assert.NotSame(t, out[0], changed[0])
+}
+
+func claNames(resources []types.Resource) []string {
+	out := make([]string, 0, len(resources))
+	for _, res := range resources {
+		out = append(out, res.(*endpointv3.ClusterLoadAssignment).ClusterName)
+	}
+	return out
+}
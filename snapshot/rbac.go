@@ -0,0 +1,157 @@
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	rbacconfigv3 "github.com/envoyproxy/go-control-plane/envoy/config/rbac/v3"
+	rbacv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/rbac/v3"
+	matcherv3 "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// AnnotationAllowNamespaces is a comma-separated list of namespaces whose ServiceAccounts may call the service
+const AnnotationAllowNamespaces = "xds.lmwn.com/allow-namespaces"
+
+// AnnotationAllowServiceAccounts is a comma-separated list of ServiceAccounts that may call the service,
+// either as namespace/name or as name in the service's namespace
+const AnnotationAllowServiceAccounts = "xds.lmwn.com/allow-service-accounts"
+
+// AnnotationAllowMethods is a comma-separated list of gRPC methods that may be called, either as
+// package.Service/Method or as package.Service for all methods of the service
+const AnnotationAllowMethods = "xds.lmwn.com/allow-methods"
+
+// rbacFilterName is the name of the RBAC HTTP filter
+const rbacFilterName = "envoy.filters.http.rbac"
+
+// rbacFromService convert annotations on the Kubernetes service to RBAC of its servers
+// It may return nil if no caller restrictions are configured. If an annotation is invalid, every call is denied
+//
+// Callers are identified by their mTLS certificate as in gRPC [A41](https://github.com/grpc/proposal/blob/master/A41-xds-rbac.md),
+// so the namespaces and ServiceAccounts restrictions require mTLS
+func rbacFromService(service *corev1.Service, mtls MTLS) *rbacv3.RBAC {
+	annotations := service.GetAnnotations()
+	namespaces, hasNamespaces := annotations[AnnotationAllowNamespaces]
+	serviceAccounts, hasServiceAccounts := annotations[AnnotationAllowServiceAccounts]
+	methods, hasMethods := annotations[AnnotationAllowMethods]
+	if !hasNamespaces && !hasServiceAccounts && !hasMethods {
+		return nil
+	}
+	if annotations := callerAnnotationsWithoutMTLS(service, mtls); len(annotations) > 0 {
+		klog.ErrorS(errors.New("mTLS is not enabled"), "callers cannot be identified, calls will be denied", "object", klog.KObj(service), "annotations", annotations)
+	}
+
+	policy := &rbacconfigv3.Policy{}
+
+	for _, namespace := range splitAnnotationList(namespaces) {
+		policy.Principals = append(policy.Principals, authenticatedPrincipal(&matcherv3.StringMatcher{
+			MatchPattern: &matcherv3.StringMatcher_Prefix{
+				Prefix: mtls.spiffeID(namespace, ""),
+			},
+		}))
+	}
+
+	for _, serviceAccount := range splitAnnotationList(serviceAccounts) {
+		namespace, name, ok := strings.Cut(serviceAccount, "/")
+		if !ok {
+			namespace, name = service.Namespace, serviceAccount
+		}
+		if namespace == "" || name == "" {
+			klog.ErrorS(fmt.Errorf("%q is not a ServiceAccount", serviceAccount), "invalid allow-service-accounts, denying all calls", "object", klog.KObj(service))
+			return denyAllRBAC()
+		}
+		policy.Principals = append(policy.Principals, authenticatedPrincipal(&matcherv3.StringMatcher{
+			MatchPattern: &matcherv3.StringMatcher_Exact{
+				Exact: mtls.spiffeID(namespace, name),
+			},
+		}))
+	}
+
+	for _, method := range splitAnnotationList(methods) {
+		path, err := methodPathMatcher(method)
+		if err != nil {
+			klog.ErrorS(err, "invalid allow-methods, denying all calls", "object", klog.KObj(service))
+			return denyAllRBAC()
+		}
+		policy.Permissions = append(policy.Permissions, &rbacconfigv3.Permission{
+			Rule: &rbacconfigv3.Permission_UrlPath{
+				UrlPath: &matcherv3.PathMatcher{
+					Rule: &matcherv3.PathMatcher_Path{Path: path},
+				},
+			},
+		})
+	}
+
+	// Annotations that are set but empty allow nothing, while missing annotations allow anything
+	if len(policy.Principals) == 0 && !hasNamespaces && !hasServiceAccounts {
+		policy.Principals = []*rbacconfigv3.Principal{{
+			Identifier: &rbacconfigv3.Principal_Any{Any: true},
+		}}
+	}
+	if len(policy.Permissions) == 0 && !hasMethods {
+		policy.Permissions = []*rbacconfigv3.Permission{{
+			Rule: &rbacconfigv3.Permission_Any{Any: true},
+		}}
+	}
+
+	out := denyAllRBAC()
+	if len(policy.Principals) > 0 && len(policy.Permissions) > 0 {
+		out.Rules.Policies["allow"] = policy
+	}
+	return out
+}
+
+// callerAnnotationsWithoutMTLS return the caller restriction annotations set on the service if mTLS is not enabled for it.
+// Callers without a certificate never match these restrictions
+func callerAnnotationsWithoutMTLS(service *corev1.Service, mtls MTLS) []string {
+	var out []string
+	for _, annotation := range []string{AnnotationAllowNamespaces, AnnotationAllowServiceAccounts} {
+		if _, ok := service.GetAnnotations()[annotation]; ok {
+			out = append(out, annotation)
+		}
+	}
+	if len(out) == 0 || mtls.isEnabled(service) {
+		return nil
+	}
+	return out
+}
+
+// denyAllRBAC return RBAC that allow nothing
+func denyAllRBAC() *rbacv3.RBAC {
+	return &rbacv3.RBAC{
+		Rules: &rbacconfigv3.RBAC{
+			Action:   rbacconfigv3.RBAC_ALLOW,
+			Policies: map[string]*rbacconfigv3.Policy{},
+		},
+	}
+}
+
+func authenticatedPrincipal(name *matcherv3.StringMatcher) *rbacconfigv3.Principal {
+	return &rbacconfigv3.Principal{
+		Identifier: &rbacconfigv3.Principal_Authenticated_{
+			Authenticated: &rbacconfigv3.Principal_Authenticated{
+				PrincipalName: name,
+			},
+		},
+	}
+}
+
+// methodPathMatcher return the matcher of the HTTP path of a gRPC method, or all methods of a gRPC service
+func methodPathMatcher(method string) (*matcherv3.StringMatcher, error) {
+	method = strings.TrimPrefix(method, "/")
+	service, name, hasName := strings.Cut(method, "/")
+	if service == "" || (hasName && (name == "" || strings.Contains(name, "/"))) {
+		return nil, fmt.Errorf("%q is not a gRPC service or method", method)
+	}
+
+	if !hasName {
+		return &matcherv3.StringMatcher{
+			MatchPattern: &matcherv3.StringMatcher_Prefix{Prefix: "/" + service + "/"},
+		}, nil
+	}
+	return &matcherv3.StringMatcher{
+		MatchPattern: &matcherv3.StringMatcher_Exact{Exact: "/" + method},
+	}, nil
+}
@@ -0,0 +1,83 @@
+package snapshot
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_rbacFromService(t *testing.T) {
+	mtls := MTLS{}
+
+	assert.Nil(t, rbacFromService(newTestService(nil), mtls))
+
+	out := rbacFromService(newTestService(map[string]string{
+		AnnotationAllowNamespaces:      "frontend",
+		AnnotationAllowServiceAccounts: "worker,payments/api",
+		AnnotationAllowMethods:         "pkg.Service/Get,/pkg.Other",
+	}), mtls)
+	require.NotNil(t, out)
+	policy := out.Rules.Policies["allow"]
+	require.NotNil(t, policy)
+
+	require.Len(t, policy.Principals, 3)
+	assert.Equal(t, "spiffe://cluster.local/ns/frontend/sa/", policy.Principals[0].GetAuthenticated().GetPrincipalName().GetPrefix())
+	assert.Equal(t, "spiffe://cluster.local/ns/default/sa/worker", policy.Principals[1].GetAuthenticated().GetPrincipalName().GetExact())
+	assert.Equal(t, "spiffe://cluster.local/ns/payments/sa/api", policy.Principals[2].GetAuthenticated().GetPrincipalName().GetExact())
+
+	require.Len(t, policy.Permissions, 2)
+	assert.Equal(t, "/pkg.Service/Get", policy.Permissions[0].GetUrlPath().GetPath().GetExact())
+	assert.Equal(t, "/pkg.Other/", policy.Permissions[1].GetUrlPath().GetPath().GetPrefix())
+
+	// Only methods are restricted
+	out = rbacFromService(newTestService(map[string]string{
+		AnnotationAllowMethods: "pkg.Service",
+	}), mtls)
+	require.NotNil(t, out)
+	policy = out.Rules.Policies["allow"]
+	require.Len(t, policy.Principals, 1)
+	assert.True(t, policy.Principals[0].GetAny())
+
+	// Only callers are restricted
+	out = rbacFromService(newTestService(map[string]string{
+		AnnotationAllowNamespaces: "frontend",
+	}), MTLS{TrustDomain: "example.com"})
+	require.NotNil(t, out)
+	policy = out.Rules.Policies["allow"]
+	assert.Equal(t, "spiffe://example.com/ns/frontend/sa/", policy.Principals[0].GetAuthenticated().GetPrincipalName().GetPrefix())
+	require.Len(t, policy.Permissions, 1)
+	assert.True(t, policy.Permissions[0].GetAny())
+
+	// Invalid and empty values deny everything
+	for _, annotations := range []map[string]string{
+		{AnnotationAllowMethods: "pkg.Service/"},
+		{AnnotationAllowMethods: "pkg.Service/Get/More"},
+		{AnnotationAllowServiceAccounts: "default/"},
+		{AnnotationAllowNamespaces: ""},
+	} {
+		out = rbacFromService(newTestService(annotations), mtls)
+		require.NotNil(t, out, annotations)
+		assert.Empty(t, out.Rules.Policies, annotations)
+	}
+}
+
+func Test_callerAnnotationsWithoutMTLS(t *testing.T) {
+	mtls := MTLS{Namespaces: []string{"default"}}
+
+	assert.Empty(t, callerAnnotationsWithoutMTLS(newTestService(map[string]string{
+		AnnotationAllowMethods: "pkg.Service",
+		AnnotationMTLS:         "false",
+	}), mtls))
+	assert.Empty(t, callerAnnotationsWithoutMTLS(newTestService(map[string]string{
+		AnnotationAllowNamespaces: "frontend",
+	}), mtls))
+	assert.Equal(t, []string{AnnotationAllowNamespaces, AnnotationAllowServiceAccounts}, callerAnnotationsWithoutMTLS(newTestService(map[string]string{
+		AnnotationAllowNamespaces:      "frontend",
+		AnnotationAllowServiceAccounts: "worker",
+	}), MTLS{}))
+	assert.Equal(t, []string{AnnotationAllowServiceAccounts}, callerAnnotationsWithoutMTLS(newTestService(map[string]string{
+		AnnotationAllowServiceAccounts: "worker",
+		AnnotationMTLS:                 "false",
+	}), mtls))
+}
@@ -0,0 +1,300 @@
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+	"k8s.io/klog/v2"
+)
+
+// resourceCache hold the resources of a single type published to a node group.
+// Each resource carries the version at which it last changed, so that a change to one service
+// only wakes up the watches that subscribed to its resources.
+//
+// State of the world watches are served here. A response always contain every subscribed resource,
+// as gRPC consider missing Listeners and Clusters deleted, and the stream only remember the resource names
+// of its last response. Delta watches are served by the embedded LinearCache.
+//
+// Watches are held until the first SetResources, so clients never see resources missing
+// while the Kubernetes objects are still being listed
+type resourceCache struct {
+	linear *cache.LinearCache
+
+	typeURL       string
+	versionPrefix string
+
+	lock      sync.Mutex
+	ready     bool
+	version   uint64
+	resources map[string]types.Resource
+	hashes    map[string]uint64
+	// versions is the version each resource last changed. Deleted resources are dropped,
+	// a stream that still know them is stale
+	versions map[string]uint64
+	watches  map[chan cache.Response]resourceWatch
+	// deltaWatches are held until ready, then forwarded to the LinearCache
+	deltaWatches map[chan cache.DeltaResponse]*deltaWatch
+}
+
+type resourceWatch struct {
+	request *cache.Request
+	// known is the resource names the stream has received
+	known map[string]struct{}
+}
+
+type deltaWatch struct {
+	request *cache.DeltaRequest
+	state   stream.StreamState
+	// cancel is the LinearCache's cancel function once the watch is forwarded
+	cancel func()
+}
+
+var _ cache.Cache = &resourceCache{}
+
+func newResourceCache(typeURL string, versionPrefix string) *resourceCache {
+	return &resourceCache{
+		linear:        cache.NewLinearCache(typeURL, cache.WithVersionPrefix(versionPrefix), cache.WithLogger(Logger)),
+		typeURL:       typeURL,
+		versionPrefix: versionPrefix,
+		resources:     map[string]types.Resource{},
+		hashes:        map[string]uint64{},
+		versions:      map[string]uint64{},
+		watches:       map[chan cache.Response]resourceWatch{},
+		deltaWatches:  map[chan cache.DeltaResponse]*deltaWatch{},
+	}
+}
+
+// SetResources replace the resources of the cache. Only resources that are added, changed or removed
+// get a new version and notify their watches.
+// Resources must not be modified once set, as the same objects are not hashed again
+func (c *resourceCache) SetResources(resources []types.Resource) (updated int, deleted int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	toUpdate := map[string]types.Resource{}
+	seen := make(map[string]struct{}, len(resources))
+	for _, res := range resources {
+		name := cache.GetResourceName(res)
+		seen[name] = struct{}{}
+		if current, ok := c.resources[name]; ok && current == res {
+			continue
+		}
+
+		hash, err := resourcesHash([]types.Resource{res})
+		if err != nil {
+			klog.ErrorS(err, "fail to hash resource", "type", c.typeURL, "name", name)
+		} else if previous, ok := c.hashes[name]; ok && previous == hash {
+			// Keep the equal object, so that it is not hashed again when it is set next time
+			c.resources[name] = res
+			continue
+		}
+		c.hashes[name] = hash
+		toUpdate[name] = res
+	}
+
+	var toDelete []string
+	for name := range c.resources {
+		if _, ok := seen[name]; !ok {
+			toDelete = append(toDelete, name)
+		}
+	}
+
+	if len(toUpdate) == 0 && len(toDelete) == 0 && c.ready {
+		return 0, 0
+	}
+
+	c.version++
+	for name, res := range toUpdate {
+		c.resources[name] = res
+		c.versions[name] = c.version
+	}
+	for _, name := range toDelete {
+		delete(c.resources, name)
+		delete(c.hashes, name)
+		delete(c.versions, name)
+	}
+	c.ready = true
+
+	if err := c.linear.UpdateResources(toUpdate, toDelete); err != nil {
+		klog.ErrorS(err, "fail to update delta resources", "type", c.typeURL)
+	}
+
+	for value, watch := range c.watches {
+		if c.respondIfStale(watch, value) {
+			delete(c.watches, value)
+		}
+	}
+	for value, watch := range c.deltaWatches {
+		watch.cancel = c.linear.CreateDeltaWatch(watch.request, watch.state, value)
+		delete(c.deltaWatches, value)
+	}
+
+	return len(toUpdate), len(toDelete)
+}
+
+// GetResources return the current resources and their versions
+func (c *resourceCache) GetResources() (map[string]types.Resource, map[string]string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	resources := make(map[string]types.Resource, len(c.resources))
+	versions := make(map[string]string, len(c.resources))
+	for name, res := range c.resources {
+		resources[name] = res
+		versions[name] = c.formatVersion(c.versions[name])
+	}
+	return resources, versions
+}
+
+func (c *resourceCache) formatVersion(version uint64) string {
+	return c.versionPrefix + strconv.FormatUint(version, 10)
+}
+
+// respondIfStale send the resources that changed since the request's version,
+// that exist but were never sent to the stream, or that the stream know but were deleted
+// c.lock must be held
+func (c *resourceCache) respondIfStale(watch resourceWatch, value chan cache.Response) bool {
+	if !c.ready {
+		return false
+	}
+
+	request := watch.request
+
+	// Versions from other instances or previous runs are always stale
+	version, ok := strings.CutPrefix(request.GetVersionInfo(), c.versionPrefix)
+	lastVersion, err := strconv.ParseUint(version, 10, 64)
+	if !ok {
+		err = errors.New("mismatched version prefix")
+	}
+
+	names := request.GetResourceNames()
+	var out []types.ResourceWithTTL
+
+	if len(names) == 0 {
+		if err == nil && lastVersion == c.version {
+			return false
+		}
+		out = make([]types.ResourceWithTTL, 0, len(c.resources))
+		for _, res := range c.resources {
+			out = append(out, types.ResourceWithTTL{Resource: res})
+		}
+	} else {
+		stale := err != nil
+		for _, name := range names {
+			_, exists := c.resources[name]
+			_, known := watch.known[name]
+			if exists != known || (exists && c.versions[name] > lastVersion) {
+				stale = true
+				break
+			}
+		}
+		if !stale {
+			return false
+		}
+		for _, name := range names {
+			if res, ok := c.resources[name]; ok {
+				out = append(out, types.ResourceWithTTL{Resource: res})
+			}
+		}
+	}
+
+	value <- &cache.RawResponse{
+		Request:   request,
+		Version:   c.formatVersion(c.version),
+		Resources: out,
+		Ctx:       context.Background(),
+	}
+	return true
+}
+
+func (c *resourceCache) CreateWatch(request *cache.Request, state stream.StreamState, value chan cache.Response) func() {
+	if request.GetTypeUrl() != c.typeURL {
+		value <- nil
+		return nil
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	watch := resourceWatch{
+		request: request,
+		known:   state.GetKnownResourceNames(c.typeURL),
+	}
+	if c.respondIfStale(watch, value) {
+		return nil
+	}
+
+	c.watches[value] = watch
+	return func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		delete(c.watches, value)
+	}
+}
+
+func (c *resourceCache) CreateDeltaWatch(request *cache.DeltaRequest, state stream.StreamState, value chan cache.DeltaResponse) func() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.ready {
+		return c.linear.CreateDeltaWatch(request, state, value)
+	}
+
+	watch := &deltaWatch{
+		request: request,
+		state:   state,
+	}
+	c.deltaWatches[value] = watch
+	return func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		delete(c.deltaWatches, value)
+		if watch.cancel != nil {
+			watch.cancel()
+		}
+	}
+}
+
+func (c *resourceCache) Fetch(ctx context.Context, request *cache.Request) (cache.Response, error) {
+	if request.GetTypeUrl() != c.typeURL {
+		return nil, fmt.Errorf("unexpected type %s", request.GetTypeUrl())
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.ready {
+		return nil, errors.New("resources are not ready")
+	}
+	version := c.formatVersion(c.version)
+	if request.GetVersionInfo() == version {
+		return nil, &types.SkipFetchError{}
+	}
+
+	var out []types.ResourceWithTTL
+	if names := request.GetResourceNames(); len(names) > 0 {
+		for _, name := range names {
+			if res, ok := c.resources[name]; ok {
+				out = append(out, types.ResourceWithTTL{Resource: res})
+			}
+		}
+	} else {
+		for _, res := range c.resources {
+			out = append(out, types.ResourceWithTTL{Resource: res})
+		}
+	}
+
+	return &cache.RawResponse{
+		Request:   request,
+		Version:   version,
+		Resources: out,
+		Ctx:       ctx,
+	}, nil
+}
@@ -0,0 +1,252 @@
+package snapshot
+
+import (
+	"context"
+	"testing"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/server/stream/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_resourceCache(t *testing.T) {
+	c := newResourceCache(resource.EndpointType, "test-")
+	state := stream.NewStreamState(false, nil)
+
+	watch := func(version string, names ...string) chan cache.Response {
+		value := make(chan cache.Response, 1)
+		c.CreateWatch(&cache.Request{TypeUrl: resource.EndpointType, VersionInfo: version, ResourceNames: names}, state, value)
+		return value
+	}
+	responseNames := func(t *testing.T, value chan cache.Response) []string {
+		t.Helper()
+		require.Len(t, value, 1)
+		response := (<-value).(*cache.RawResponse)
+		var out []string
+		for _, res := range response.Resources {
+			out = append(out, cache.GetResourceName(res.Resource))
+		}
+		return out
+	}
+
+	// Watches are held until the resources are known
+	pending := watch("", "a")
+	assert.Empty(t, pending)
+
+	updated, deleted := c.SetResources([]types.Resource{
+		&endpointv3.ClusterLoadAssignment{ClusterName: "a"},
+		&endpointv3.ClusterLoadAssignment{ClusterName: "b"},
+	})
+	assert.Equal(t, 2, updated)
+	assert.Equal(t, 0, deleted)
+	assert.Equal(t, []string{"a"}, responseNames(t, pending))
+
+	state.SetKnownResourceNamesAsList(resource.EndpointType, []string{"a", "b"})
+	watchA := watch("test-1", "a")
+	watchB := watch("test-1", "b")
+	assert.Empty(t, watchA)
+	assert.Empty(t, watchB)
+
+	// Only the watch of the changed resource is notified
+	updated, _ = c.SetResources([]types.Resource{
+		&endpointv3.ClusterLoadAssignment{ClusterName: "a"},
+		&endpointv3.ClusterLoadAssignment{ClusterName: "b", Endpoints: []*endpointv3.LocalityLbEndpoints{{}}},
+	})
+	assert.Equal(t, 1, updated)
+	assert.Empty(t, watchA)
+	assert.Equal(t, []string{"b"}, responseNames(t, watchB))
+
+	// Unchanged resources do not bump the version
+	updated, deleted = c.SetResources([]types.Resource{
+		&endpointv3.ClusterLoadAssignment{ClusterName: "a"},
+		&endpointv3.ClusterLoadAssignment{ClusterName: "b", Endpoints: []*endpointv3.LocalityLbEndpoints{{}}},
+	})
+	assert.Equal(t, 0, updated)
+	assert.Equal(t, 0, deleted)
+	assert.Empty(t, watchA)
+
+	// Equal objects replace the cached ones, so that the same objects are not hashed again
+	b := &endpointv3.ClusterLoadAssignment{ClusterName: "b", Endpoints: []*endpointv3.LocalityLbEndpoints{{}}}
+	updated, _ = c.SetResources([]types.Resource{&endpointv3.ClusterLoadAssignment{ClusterName: "a"}, b})
+	assert.Equal(t, 0, updated)
+	assert.Same(t, b, c.resources["b"])
+
+	// Resources never sent to the stream are stale
+	state.SetKnownResourceNamesAsList(resource.EndpointType, []string{"a"})
+	assert.Equal(t, []string{"b"}, responseNames(t, watch("test-3", "b", "c")))
+
+	// Versions of another instance are stale
+	assert.Equal(t, []string{"a"}, responseNames(t, watch("other-2", "a")))
+
+	// Deleted resources are stale only to streams that know them
+	state.SetKnownResourceNamesAsList(resource.EndpointType, []string{"a", "b"})
+	watchB = watch("test-2", "b")
+	_, deleted = c.SetResources([]types.Resource{
+		&endpointv3.ClusterLoadAssignment{ClusterName: "a"},
+	})
+	assert.Equal(t, 1, deleted)
+	assert.NotContains(t, c.versions, "b")
+	assert.Empty(t, responseNames(t, watchB))
+
+	state.SetKnownResourceNamesAsList(resource.EndpointType, []string{"a"})
+	assert.Empty(t, watch("test-4", "a", "b"))
+}
+
+func Test_resourceCache_fullState(t *testing.T) {
+	c := newResourceCache(resource.ClusterType, "test-")
+	state := stream.NewStreamState(false, nil)
+	c.SetResources([]types.Resource{
+		&clusterv3.Cluster{Name: "a"},
+		&clusterv3.Cluster{Name: "b"},
+	})
+
+	state.SetKnownResourceNamesAsList(resource.ClusterType, []string{"a", "b"})
+
+	value := make(chan cache.Response, 1)
+	c.CreateWatch(&cache.Request{TypeUrl: resource.ClusterType, VersionInfo: "test-1", ResourceNames: []string{"a", "b"}}, state, value)
+	assert.Empty(t, value)
+
+	c.SetResources([]types.Resource{
+		&clusterv3.Cluster{Name: "a"},
+		&clusterv3.Cluster{Name: "b", LbPolicy: clusterv3.Cluster_RING_HASH},
+	})
+
+	// Clusters must be sent all together, otherwise the client consider the missing ones deleted
+	require.Len(t, value, 1)
+	response := (<-value).(*cache.RawResponse)
+	assert.Equal(t, "test-2", response.Version)
+	assert.Len(t, response.Resources, 2)
+}
+
+func Test_resourceCache_knownAfterResponse(t *testing.T) {
+	c := newResourceCache(resource.EndpointType, "test-")
+	state := stream.NewStreamState(false, nil)
+	c.SetResources([]types.Resource{
+		&endpointv3.ClusterLoadAssignment{ClusterName: "a"},
+		&endpointv3.ClusterLoadAssignment{ClusterName: "b"},
+	})
+	state.SetKnownResourceNamesAsList(resource.EndpointType, []string{"a", "b"})
+
+	value := make(chan cache.Response, 1)
+	c.CreateWatch(&cache.Request{TypeUrl: resource.EndpointType, VersionInfo: "test-1", ResourceNames: []string{"a", "b"}}, state, value)
+	c.SetResources([]types.Resource{
+		&endpointv3.ClusterLoadAssignment{ClusterName: "a"},
+		&endpointv3.ClusterLoadAssignment{ClusterName: "b", Endpoints: []*endpointv3.LocalityLbEndpoints{{}}},
+	})
+	require.Len(t, value, 1)
+	response := (<-value).(*cache.RawResponse)
+	assert.Len(t, response.Resources, 2)
+
+	// The server replace the known names with those of the last response,
+	// so the next request must not find the unchanged resource stale
+	var names []string
+	for _, res := range response.Resources {
+		names = append(names, cache.GetResourceName(res.Resource))
+	}
+	state.SetKnownResourceNamesAsList(resource.EndpointType, names)
+	c.CreateWatch(&cache.Request{TypeUrl: resource.EndpointType, VersionInfo: response.Version, ResourceNames: []string{"a", "b"}}, state, value)
+	assert.Empty(t, value)
+}
+
+func Test_resourceCache_delta(t *testing.T) {
+	c := newResourceCache(resource.EndpointType, "test-")
+	state := stream.NewStreamState(false, nil)
+	state.SetSubscribedResourceNames(map[string]struct{}{"a": {}})
+
+	watch := func() chan cache.DeltaResponse {
+		value := make(chan cache.DeltaResponse, 1)
+		c.CreateDeltaWatch(&cache.DeltaRequest{TypeUrl: resource.EndpointType}, state, value)
+		return value
+	}
+	receive := func(t *testing.T, value chan cache.DeltaResponse) *cache.RawDeltaResponse {
+		t.Helper()
+		require.Len(t, value, 1)
+		response := (<-value).(*cache.RawDeltaResponse)
+		state.SetResourceVersions(response.GetNextVersionMap())
+		return response
+	}
+	names := func(response *cache.RawDeltaResponse) []string {
+		var out []string
+		for _, res := range response.Resources {
+			out = append(out, cache.GetResourceName(res))
+		}
+		return out
+	}
+
+	// Watches are held until the resources are known, otherwise the first wildcard request is
+	// answered with no resources
+	wildcard := make(chan cache.DeltaResponse, 1)
+	c.CreateDeltaWatch(&cache.DeltaRequest{TypeUrl: resource.EndpointType}, stream.NewStreamState(true, nil), wildcard)
+	value := watch()
+	cancelled := make(chan cache.DeltaResponse, 1)
+	cancel := c.CreateDeltaWatch(&cache.DeltaRequest{TypeUrl: resource.EndpointType}, state, cancelled)
+	cancel()
+	assert.Empty(t, wildcard)
+	assert.Empty(t, value)
+
+	// Subscribe
+	c.SetResources([]types.Resource{
+		&endpointv3.ClusterLoadAssignment{ClusterName: "a"},
+		&endpointv3.ClusterLoadAssignment{ClusterName: "b"},
+	})
+	assert.Equal(t, []string{"a"}, names(receive(t, value)))
+	assert.Empty(t, cancelled)
+	require.Len(t, wildcard, 1)
+	assert.Len(t, (<-wildcard).(*cache.RawDeltaResponse).Resources, 2)
+
+	// Change
+	value = watch()
+	assert.Empty(t, value)
+	c.SetResources([]types.Resource{
+		&endpointv3.ClusterLoadAssignment{ClusterName: "a", Endpoints: []*endpointv3.LocalityLbEndpoints{{}}},
+		&endpointv3.ClusterLoadAssignment{ClusterName: "b"},
+	})
+	assert.Equal(t, []string{"a"}, names(receive(t, value)))
+
+	// Changes to resources not subscribed are not sent
+	value = watch()
+	c.SetResources([]types.Resource{
+		&endpointv3.ClusterLoadAssignment{ClusterName: "a", Endpoints: []*endpointv3.LocalityLbEndpoints{{}}},
+	})
+	assert.Empty(t, value)
+
+	// Delete
+	c.SetResources(nil)
+	response := receive(t, value)
+	assert.Empty(t, response.Resources)
+	assert.Equal(t, []string{"a"}, response.RemovedResources)
+}
+
+func Test_resourceCache_Fetch(t *testing.T) {
+	c := newResourceCache(resource.ClusterType, "test-")
+	fetch := func(version string, names ...string) (cache.Response, error) {
+		return c.Fetch(context.Background(), &cache.Request{TypeUrl: resource.ClusterType, VersionInfo: version, ResourceNames: names})
+	}
+
+	_, err := fetch("")
+	assert.Error(t, err)
+
+	c.SetResources([]types.Resource{
+		&clusterv3.Cluster{Name: "a"},
+		&clusterv3.Cluster{Name: "b"},
+	})
+
+	response, err := fetch("")
+	require.NoError(t, err)
+	assert.Equal(t, "test-1", response.(*cache.RawResponse).Version)
+	assert.Len(t, response.(*cache.RawResponse).Resources, 2)
+
+	response, err = fetch("", "b", "c")
+	require.NoError(t, err)
+	require.Len(t, response.(*cache.RawResponse).Resources, 1)
+	assert.Equal(t, "b", cache.GetResourceName(response.(*cache.RawResponse).Resources[0].Resource))
+
+	var skip *types.SkipFetchError
+	_, err = fetch("test-1")
+	assert.ErrorAs(t, err, &skip)
+}
@@ -0,0 +1,176 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	k8scache "k8s.io/client-go/tools/cache"
+)
+
+// Scope limits the Services and Endpoints watched by the Snapshotter
+type Scope struct {
+	// Namespaces to watch. All namespaces are watched if empty
+	Namespaces []string `json:"namespaces,omitempty"`
+	// ExcludeNamespaces are not watched. Only applicable when Namespaces is empty
+	ExcludeNamespaces []string `json:"excludeNamespaces,omitempty"`
+	// LabelSelector is applied to both Services and Endpoints/EndpointSlices.
+	// Kubernetes copy the Service's labels to its Endpoints and EndpointSlices
+	LabelSelector string `json:"labelSelector,omitempty"`
+	// FieldSelector is applied to Services only, as Endpoints and EndpointSlices
+	// do not support the same fields (eg. spec.type)
+	FieldSelector string `json:"fieldSelector,omitempty"`
+}
+
+// Validate return error if the selectors cannot be parsed
+func (sc Scope) Validate() error {
+	if len(sc.Namespaces) > 0 && len(sc.ExcludeNamespaces) > 0 {
+		return fmt.Errorf("namespaces and excluded namespaces cannot be used together")
+	}
+	if _, err := labels.Parse(sc.LabelSelector); err != nil {
+		return fmt.Errorf("invalid label selector: %w", err)
+	}
+	if _, err := fields.ParseSelector(sc.fieldSelector(true)); err != nil {
+		return fmt.Errorf("invalid field selector: %w", err)
+	}
+	return nil
+}
+
+// IsClusterWide return whether watching this scope requires cluster-wide access
+func (sc Scope) IsClusterWide() bool {
+	return len(sc.Namespaces) == 0
+}
+
+func (sc Scope) namespaces() []string {
+	if sc.IsClusterWide() {
+		return []string{metav1.NamespaceAll}
+	}
+	return sc.Namespaces
+}
+
+func (sc Scope) fieldSelector(isService bool) string {
+	var selectors []string
+	if isService && sc.FieldSelector != "" {
+		selectors = append(selectors, sc.FieldSelector)
+	}
+	if sc.IsClusterWide() {
+		for _, namespace := range sc.ExcludeNamespaces {
+			selectors = append(selectors, "metadata.namespace!="+namespace)
+		}
+	}
+	return strings.Join(selectors, ",")
+}
+
+func (sc Scope) applyTo(options *metav1.ListOptions, expectedType runtime.Object) {
+	_, isService := expectedType.(*corev1.Service)
+	options.LabelSelector = sc.LabelSelector
+	options.FieldSelector = sc.fieldSelector(isService)
+}
+
+// scopedReflector run a reflector for each namespace in the scope and merge their stores.
+// onChange is called only after every reflector has listed its namespace
+type scopedReflector struct {
+	stores     []*k8scache.UndeltaStore
+	reflectors []*k8scache.Reflector
+	synced     []atomic.Bool
+
+	// lock serialize onChange of the reflectors, which run in their own goroutines,
+	// so that the list of an older change is never published after a newer one
+	lock sync.Mutex
+}
+
+func (s *Snapshotter) newScopedReflector(expectedType runtime.Object, listWatch func(namespace string) *k8scache.ListWatch, onChange func()) *scopedReflector {
+	namespaces := s.scope.namespaces()
+	out := &scopedReflector{
+		synced: make([]atomic.Bool, len(namespaces)),
+	}
+
+	for i, namespace := range namespaces {
+		store := k8scache.NewUndeltaStore(func(v []interface{}) {
+			out.lock.Lock()
+			defer out.lock.Unlock()
+
+			out.synced[i].Store(true)
+			if out.hasSynced() {
+				onChange()
+			}
+		}, k8scache.DeletionHandlingMetaNamespaceKeyFunc)
+
+		lw := listWatch(namespace)
+		reflector := k8scache.NewReflector(&k8scache.ListWatch{
+			ListWithContextFunc: func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+				s.scope.applyTo(&options, expectedType)
+				return lw.ListWithContextFunc(ctx, options)
+			},
+			WatchFuncWithContext: func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
+				s.scope.applyTo(&options, expectedType)
+				return lw.WatchFuncWithContext(ctx, options)
+			},
+		}, expectedType, store, s.ResyncPeriod)
+
+		out.stores = append(out.stores, store)
+		out.reflectors = append(out.reflectors, reflector)
+	}
+
+	return out
+}
+
+func (r *scopedReflector) hasSynced() bool {
+	for i := range r.synced {
+		if !r.synced[i].Load() {
+			return false
+		}
+	}
+	return true
+}
+
+// Locked run f while no onChange is running. It is for callers that list and publish outside of onChange
+func (r *scopedReflector) Locked(f func()) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	f()
+}
+
+// List return objects of all namespaces
+func (r *scopedReflector) List() []interface{} {
+	if len(r.stores) == 1 {
+		return r.stores[0].List()
+	}
+	var out []interface{}
+	for _, store := range r.stores {
+		out = append(out, store.List()...)
+	}
+	return out
+}
+
+func (r *scopedReflector) LastSyncResourceVersion() string {
+	if len(r.reflectors) == 1 {
+		return r.reflectors[0].LastSyncResourceVersion()
+	}
+	versions := make([]string, len(r.reflectors))
+	for i, reflector := range r.reflectors {
+		versions[i] = reflector.LastSyncResourceVersion()
+	}
+	return strings.Join(versions, ",")
+}
+
+// Run all reflectors until ctx is done
+func (r *scopedReflector) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, reflector := range r.reflectors {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reflector.Run(ctx.Done())
+		}()
+	}
+	wg.Wait()
+}
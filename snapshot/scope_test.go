@@ -0,0 +1,138 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8scache "k8s.io/client-go/tools/cache"
+)
+
+func TestScope_applyTo(t *testing.T) {
+	for _, testcase := range []struct {
+		Name                string
+		Scope               Scope
+		ExpectLabel         string
+		ExpectField         string
+		ExpectEndpointField string
+		ExpectInvalid       bool
+	}{
+		{
+			Name: "empty",
+		},
+		{
+			Name:        "selectors",
+			Scope:       Scope{LabelSelector: "team=a", FieldSelector: "metadata.name!=kubernetes"},
+			ExpectLabel: "team=a",
+			ExpectField: "metadata.name!=kubernetes",
+		},
+		{
+			Name:        "service only field",
+			Scope:       Scope{FieldSelector: "spec.type=ClusterIP"},
+			ExpectField: "spec.type=ClusterIP",
+		},
+		{
+			Name:                "exclude namespaces",
+			Scope:               Scope{ExcludeNamespaces: []string{"kube-system", "monitoring"}, FieldSelector: "metadata.name!=kubernetes"},
+			ExpectField:         "metadata.name!=kubernetes,metadata.namespace!=kube-system,metadata.namespace!=monitoring",
+			ExpectEndpointField: "metadata.namespace!=kube-system,metadata.namespace!=monitoring",
+		},
+		{
+			Name:          "invalid label selector",
+			Scope:         Scope{LabelSelector: "team in (a"},
+			ExpectLabel:   "team in (a",
+			ExpectInvalid: true,
+		},
+		{
+			Name:          "include and exclude",
+			Scope:         Scope{Namespaces: []string{"a"}, ExcludeNamespaces: []string{"b"}},
+			ExpectInvalid: true,
+		},
+	} {
+		t.Run(testcase.Name, func(t *testing.T) {
+			if testcase.ExpectInvalid {
+				assert.Error(t, testcase.Scope.Validate())
+				return
+			}
+			assert.NoError(t, testcase.Scope.Validate())
+
+			options := metav1.ListOptions{}
+			testcase.Scope.applyTo(&options, &corev1.Service{})
+			assert.Equal(t, testcase.ExpectLabel, options.LabelSelector)
+			assert.Equal(t, testcase.ExpectField, options.FieldSelector)
+
+			for _, expectedType := range []runtime.Object{&corev1.Endpoints{}, &discoveryv1.EndpointSlice{}} {
+				options := metav1.ListOptions{}
+				testcase.Scope.applyTo(&options, expectedType)
+				assert.Equal(t, testcase.ExpectLabel, options.LabelSelector)
+				assert.Equal(t, testcase.ExpectEndpointField, options.FieldSelector)
+			}
+		})
+	}
+}
+
+func TestScopedReflector_concurrentNamespaces(t *testing.T) {
+	client := fake.NewClientset()
+	s := New(client, WithScope(Scope{Namespaces: []string{"a", "b"}}))
+
+	var active atomic.Int32
+	var overlapped atomic.Bool
+	var reflector *scopedReflector
+	var lastCount atomic.Int32
+	reflector = s.newScopedReflector(&corev1.Service{}, func(namespace string) *k8scache.ListWatch {
+		return &k8scache.ListWatch{
+			ListWithContextFunc: func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+				return client.CoreV1().Services(namespace).List(ctx, options)
+			},
+			WatchFuncWithContext: func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
+				return client.CoreV1().Services(namespace).Watch(ctx, options)
+			},
+		}
+	}, func() {
+		if active.Add(1) > 1 {
+			overlapped.Store(true)
+		}
+		defer active.Add(-1)
+
+		// Widen the window for a concurrent call
+		time.Sleep(time.Millisecond)
+		lastCount.Store(int32(len(reflector.List())))
+	})
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go reflector.Run(ctx)
+	require.Eventually(t, reflector.hasSynced, 5*time.Second, 10*time.Millisecond)
+
+	var wg sync.WaitGroup
+	for _, namespace := range []string{"a", "b"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 20 {
+				_, err := client.CoreV1().Services(namespace).Create(ctx, &corev1.Service{
+					ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("svc-%d", i), Namespace: namespace},
+				}, metav1.CreateOptions{})
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The last published list always has every service
+	require.Eventually(t, func() bool {
+		return lastCount.Load() == 40
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.False(t, overlapped.Load(), "onChange must not run concurrently")
+}
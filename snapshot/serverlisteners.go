@@ -0,0 +1,185 @@
+package snapshot
+
+import (
+	"cmp"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/ccoveille/go-safecast"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	routerv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
+	managerv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
+	"google.golang.org/protobuf/types/known/anypb"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// ServerListenerNamePrefix is the server_listener_resource_name_template that gRPC xDS servers must have
+// in their bootstrap, without the %s placeholder of the listening address
+const ServerListenerNamePrefix = "grpc/server?xds.resource.listening_address="
+
+// serverListenerName return the name of the Listener of servers listening on the IP and port
+func serverListenerName(ip string, port int32) string {
+	return ServerListenerNamePrefix + net.JoinHostPort(ip, strconv.Itoa(int(port)))
+}
+
+// serverListenerCacheItem is the server Listeners of a service, reused while the service and its endpoints are unchanged
+type serverListenerCacheItem struct {
+	service          *corev1.Service
+	endpointsVersion string
+	listeners        []*listenerv3.Listener
+}
+
+// serverListeners return the Listener of every address that the services' endpoints listen on.
+// If an address belongs to multiple services, the first service by namespace and name is used.
+// The Listeners of a service are only rebuilt when the service or its endpoints change, so that
+// the published Listeners are not hashed again
+// s.groupsLock must be held
+func (s *Snapshotter) serverListeners(services []*corev1.Service) []types.Resource {
+	var out []types.Resource
+	owners := map[string]*corev1.Service{}
+	if s.serverListenerCache == nil {
+		s.serverListenerCache = map[string]serverListenerCacheItem{}
+	}
+
+	services = slices.Clone(services)
+	slices.SortFunc(services, func(a, b *corev1.Service) int {
+		return cmp.Or(cmp.Compare(a.Namespace, b.Namespace), cmp.Compare(a.Name, b.Name))
+	})
+
+	for _, svc := range services {
+		name := svc.Namespace + "/" + svc.Name
+		ep, ok := s.serviceEndpoints[name]
+		if !ok {
+			continue
+		}
+		item, ok := s.serverListenerCache[name]
+		if !ok || item.service != svc || item.endpointsVersion != ep.Version {
+			item = serverListenerCacheItem{
+				service:          svc,
+				endpointsVersion: ep.Version,
+				listeners:        serverListenersFromService(svc, ep, s.mtls),
+			}
+			s.serverListenerCache[name] = item
+		}
+		for _, listener := range item.listeners {
+			if owner, ok := owners[listener.Name]; ok {
+				klog.V(4).InfoS("server listener is already used by another service", "object", klog.KObj(svc), "owner", klog.KObj(owner), "listener", listener.Name)
+				continue
+			}
+			owners[listener.Name] = svc
+			out = append(out, listener)
+		}
+	}
+
+	return out
+}
+
+// serverListenersFromService build the Listener of each address of the service's endpoints, including
+// endpoints that are not ready as gRPC xDS servers do not serve until they receive their Listener
+//
+// The Listeners are as in gRPC [A36](https://github.com/grpc/proposal/blob/master/A36-xds-for-servers.md)
+func serverListenersFromService(service *corev1.Service, ep *serviceEndpoints, mtls MTLS) []*listenerv3.Listener {
+	var out []*listenerv3.Listener
+	seen := map[string]bool{}
+
+	portNames := make([]string, 0, len(ep.Ports))
+	for portName := range ep.Ports {
+		portNames = append(portNames, portName)
+	}
+	sort.Strings(portNames)
+
+	transportSocket := mtls.serverTransportSocketFromService(service)
+	var httpFilters []*managerv3.HttpFilter
+	if rbac := rbacFromService(service, mtls); rbac != nil {
+		rbacConfig, _ := anypb.New(rbac)
+		httpFilters = append(httpFilters, &managerv3.HttpFilter{
+			Name: rbacFilterName,
+			ConfigType: &managerv3.HttpFilter_TypedConfig{
+				TypedConfig: rbacConfig,
+			},
+		})
+	}
+
+	for _, portName := range portNames {
+		for _, addr := range ep.Ports[portName] {
+			name := serverListenerName(addr.IP, addr.Port)
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			out = append(out, serverListener(name, addr, httpFilters, transportSocket))
+		}
+	}
+
+	return out
+}
+
+func serverListener(name string, addr endpointAddress, httpFilters []*managerv3.HttpFilter, transportSocket *corev3.TransportSocket) *listenerv3.Listener {
+	portU32, err := safecast.ToUint32(addr.Port)
+	if err != nil {
+		panic(err)
+	}
+
+	router, _ := anypb.New(&routerv3.Router{})
+	manager, _ := anypb.New(&managerv3.HttpConnectionManager{
+		StatPrefix: name,
+		HttpFilters: append(slices.Clip(httpFilters), &managerv3.HttpFilter{
+			Name: wellknown.Router,
+			ConfigType: &managerv3.HttpFilter_TypedConfig{
+				TypedConfig: router,
+			},
+		}),
+		RouteSpecifier: &managerv3.HttpConnectionManager_RouteConfig{
+			RouteConfig: &routev3.RouteConfiguration{
+				Name: name,
+				VirtualHosts: []*routev3.VirtualHost{{
+					Name:    "default",
+					Domains: []string{"*"},
+					Routes: []*routev3.Route{{
+						Name: "default",
+						Match: &routev3.RouteMatch{
+							PathSpecifier: &routev3.RouteMatch_Prefix{},
+						},
+						Action: &routev3.Route_NonForwardingAction{
+							NonForwardingAction: &routev3.NonForwardingAction{},
+						},
+					}},
+				}},
+			},
+		},
+	})
+
+	return &listenerv3.Listener{
+		Name: name,
+		Address: &corev3.Address{
+			Address: &corev3.Address_SocketAddress{
+				SocketAddress: &corev3.SocketAddress{
+					Protocol: corev3.SocketAddress_TCP,
+					Address:  addr.IP,
+					PortSpecifier: &corev3.SocketAddress_PortValue{
+						PortValue: portU32,
+					},
+				},
+			},
+		},
+		TrafficDirection: corev3.TrafficDirection_INBOUND,
+		FilterChains: []*listenerv3.FilterChain{{
+			Name: "default",
+			Filters: []*listenerv3.Filter{{
+				Name: wellknown.HTTPConnectionManager,
+				ConfigType: &listenerv3.Filter_TypedConfig{
+					TypedConfig: manager,
+				},
+			}},
+			TransportSocket: transportSocket,
+		}},
+	}
+}
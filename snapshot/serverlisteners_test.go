@@ -0,0 +1,82 @@
+package snapshot
+
+import (
+	"testing"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	managerv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_serverListenersFromService(t *testing.T) {
+	service := newTestService(nil)
+	ep := &serviceEndpoints{
+		Name:      "app",
+		Namespace: "default",
+		Ports: map[string][]endpointAddress{
+			"grpc": {
+				{IP: "10.0.0.1", Port: 8080, HealthStatus: corev3.HealthStatus_HEALTHY},
+				{IP: "10.0.0.2", Port: 8080, HealthStatus: corev3.HealthStatus_UNHEALTHY},
+			},
+			// The same target port listed under another service port
+			"grpc-alt": {
+				{IP: "10.0.0.1", Port: 8080, HealthStatus: corev3.HealthStatus_HEALTHY},
+			},
+			"ipv6": {
+				{IP: "fd00::1", Port: 9090, HealthStatus: corev3.HealthStatus_HEALTHY},
+			},
+		},
+	}
+
+	out := serverListenersFromService(service, ep, MTLS{})
+	var names []string
+	for _, listener := range out {
+		names = append(names, listener.Name)
+	}
+	assert.Equal(t, []string{
+		"grpc/server?xds.resource.listening_address=10.0.0.1:8080",
+		"grpc/server?xds.resource.listening_address=10.0.0.2:8080",
+		"grpc/server?xds.resource.listening_address=[fd00::1]:9090",
+	}, names)
+
+	listener := out[0]
+	assert.Equal(t, "10.0.0.1", listener.GetAddress().GetSocketAddress().GetAddress())
+	assert.Equal(t, uint32(8080), listener.GetAddress().GetSocketAddress().GetPortValue())
+	require.Len(t, listener.FilterChains, 1)
+	assert.Nil(t, listener.FilterChains[0].TransportSocket)
+
+	manager := &managerv3.HttpConnectionManager{}
+	require.NoError(t, listener.FilterChains[0].Filters[0].GetTypedConfig().UnmarshalTo(manager))
+	assert.Equal(t, "envoy.filters.http.router", manager.HttpFilters[len(manager.HttpFilters)-1].Name)
+	route := manager.GetRouteConfig().GetVirtualHosts()[0].GetRoutes()[0]
+	assert.NotNil(t, route.GetNonForwardingAction())
+
+	out = serverListenersFromService(service, ep, MTLS{Namespaces: []string{"default"}})
+	assert.Equal(t, "envoy.transport_sockets.tls", out[0].FilterChains[0].GetTransportSocket().GetName())
+}
+
+func TestSnapshotter_serverListeners_cache(t *testing.T) {
+	service := newTestService(nil)
+	ep := &serviceEndpoints{
+		Name:      "app",
+		Namespace: "default",
+		Version:   "1",
+		Ports: map[string][]endpointAddress{
+			"grpc": {{IP: "10.0.0.1", Port: 8080, HealthStatus: corev3.HealthStatus_HEALTHY}},
+		},
+	}
+	s := &Snapshotter{
+		serviceEndpoints: map[string]*serviceEndpoints{"default/app": ep},
+	}
+
+	out := s.serverListeners([]*corev1.Service{service})
+	require.Len(t, out, 1)
+
+	// Listeners of unchanged services and endpoints are reused, so they are not hashed again
+	assert.Same(t, out[0], s.serverListeners([]*corev1.Service{service})[0])
+
+	s.serviceEndpoints["default/app"] = &serviceEndpoints{Name: "app", Namespace: "default", Version: "2", Ports: ep.Ports}
+	assert.NotSame(t, out[0], s.serverListeners([]*corev1.Service{service})[0])
+}
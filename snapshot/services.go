@@ -2,8 +2,10 @@ package snapshot
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"slices"
 	"strconv"
 
 	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
@@ -13,10 +15,8 @@ import (
 	routerv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
 	managerv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
-	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/wellknown"
 	"github.com/wongnai/xds/meter"
-	"github.com/wongnai/xds/snapshot/apigateway"
 	"go.opentelemetry.io/otel/metric"
 	"google.golang.org/protobuf/types/known/anypb"
 	corev1 "k8s.io/api/core/v1"
@@ -32,54 +32,30 @@ func (s *Snapshotter) startServices(ctx context.Context) error {
 		klog.Warning("emit before ready")
 	}
 
-	store := k8scache.NewUndeltaStore(func(v []interface{}) {
+	reflector := s.newScopedReflector(&corev1.Service{}, func(namespace string) *k8scache.ListWatch {
+		return &k8scache.ListWatch{
+			ListWithContextFunc: func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
+				return s.client.CoreV1().Services(namespace).List(ctx, options)
+			},
+			WatchFuncWithContext: func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
+				return s.client.CoreV1().Services(namespace).Watch(ctx, options)
+			},
+		}
+	}, func() {
 		emit()
-	}, k8scache.DeletionHandlingMetaNamespaceKeyFunc)
-
-	reflector := k8scache.NewReflector(&k8scache.ListWatch{
-		ListWithContextFunc: func(ctx context.Context, options metav1.ListOptions) (runtime.Object, error) {
-			return s.client.CoreV1().Services("").List(ctx, options)
-		},
-		WatchFuncWithContext: func(ctx context.Context, options metav1.ListOptions) (watch.Interface, error) {
-			return s.client.CoreV1().Services("").Watch(ctx, options)
-		},
-	}, &corev1.Service{}, store, s.ResyncPeriod)
-
-	var lastSnapshotHash uint64
+	})
 
 	emit = func() {
-		version := reflector.LastSyncResourceVersion()
 		s.kubeEventCounter.Add(ctx, 1, metric.WithAttributes(meter.ResourceAttrKey.String("services")))
 
-		services := sliceToService(store.List())
-		resources := kubeServicesToResources(services)
-		apiGatewayResources, apiGatewayStats := apigateway.FromKubeServices(services)
-		merged := append(resources, apiGatewayResources...) //nolint:gocritic
-
-		resourcesByType := resourcesToMap(merged)
-		s.setServiceResourcesByType(resourcesByType)
-		s.setAPIGatewayStats(apiGatewayStats)
-
-		hash, err := resourcesHash(merged)
-		if err == nil {
-			if hash == lastSnapshotHash {
-				klog.V(4).Info("new snapshot is equivalent to the previous one")
-				return
-			}
-			lastSnapshotHash = hash
-		} else {
-			klog.Errorf("fail to hash snapshot: %s", err)
-		}
-
-		snapshot, err := cache.NewSnapshot(version, resourcesByType)
-		if err != nil {
-			panic(err)
+		services := sliceToService(reflector.List())
+		s.setServices(reflector.LastSyncResourceVersion(), services)
+		if s.setHeadlessServices(services) {
+			s.refreshEndpoints()
 		}
-
-		s.servicesCache.SetSnapshot(ctx, "", snapshot)
 	}
 
-	reflector.Run(ctx.Done())
+	reflector.Run(ctx)
 	return nil
 }
 
@@ -94,51 +70,94 @@ func sliceToService(s []interface{}) []*corev1.Service {
 // kubeServicesToResources convert list of Kubernetes services to
 // - Listener for each ports
 // - RouteConfiguration for those listeners
-// - Cluster
-func kubeServicesToResources(services []*corev1.Service) []types.Resource {
+// - Cluster, with TLS if mTLS is enabled for the service. External services have LOGICAL_DNS clusters
+// - Aggregate Cluster if the service fails over to another service
+func kubeServicesToResources(services []*corev1.Service, mtls MTLS) []types.Resource {
 	var out []types.Resource
 
 	router, _ := anypb.New(&routerv3.Router{})
+	servicesIndex := servicesByName(services)
 
 	for _, svc := range services {
 		fullName := fmt.Sprintf("%s.%s", svc.Name, svc.Namespace)
+
+		var httpFilters []*managerv3.HttpFilter
+		if fault := faultFromService(svc); fault != nil {
+			faultConfig, _ := anypb.New(fault)
+			httpFilters = append(httpFilters, &managerv3.HttpFilter{
+				Name: wellknown.Fault,
+				ConfigType: &managerv3.HttpFilter_TypedConfig{
+					TypedConfig: faultConfig,
+				},
+			})
+		}
+		statefulSession := statefulSessionFromService(svc)
+		if statefulSession != nil {
+			statefulSessionConfig, _ := anypb.New(statefulSession)
+			httpFilters = append(httpFilters, &managerv3.HttpFilter{
+				Name: statefulSessionFilterName,
+				ConfigType: &managerv3.HttpFilter_TypedConfig{
+					TypedConfig: statefulSessionConfig,
+				},
+				// Clients that do not support stateful session ignore it
+				IsOptional: true,
+			})
+		}
+
 		for _, port := range svc.Spec.Ports {
 			targetHostPort := net.JoinHostPort(fullName, port.Name)
 			targetHostPortNumber := net.JoinHostPort(fullName, strconv.Itoa(int(port.Port)))
 
+			routeAction := &routev3.RouteAction{
+				ClusterSpecifier: &routev3.RouteAction_Cluster{
+					Cluster: targetHostPort,
+				},
+				RetryPolicy:       retryPolicyFromService(svc),
+				MaxStreamDuration: maxStreamDurationFromService(svc),
+				HashPolicy:        hashPolicyFromService(svc),
+			}
+			failoverCluster := failoverClusterFromService(svc, port, servicesIndex)
+			if weightedClusters := weightedClustersFromService(svc, port, servicesIndex); weightedClusters != nil {
+				routeAction.ClusterSpecifier = &routev3.RouteAction_WeightedClusters{
+					WeightedClusters: weightedClusters,
+				}
+				// Traffic split takes precedence over failover
+				if failoverCluster != nil {
+					klog.ErrorS(errors.New("traffic-split is also set"), "failover is ignored", "object", klog.KObj(svc), "failover", svc.GetAnnotations()[AnnotationFailover])
+					failoverCluster = nil
+				}
+			} else if failoverCluster != nil {
+				routeAction.ClusterSpecifier = &routev3.RouteAction_Cluster{
+					Cluster: failoverCluster.Name,
+				}
+			}
+
 			routeConfig := &routev3.RouteConfiguration{
 				Name: targetHostPortNumber,
 				VirtualHosts: []*routev3.VirtualHost{
 					{
 						Name:    targetHostPort,
 						Domains: []string{fullName, targetHostPort, targetHostPortNumber, svc.Name},
-						Routes: []*routev3.Route{{
+						Routes: append(headerRoutesFromService(svc, port, servicesIndex, routeAction), &routev3.Route{
 							Name: "default",
 							Match: &routev3.RouteMatch{
 								PathSpecifier: &routev3.RouteMatch_Prefix{},
 							},
 							Action: &routev3.Route_Route{
-								Route: &routev3.RouteAction{
-									ClusterSpecifier: &routev3.RouteAction_Cluster{
-										Cluster: targetHostPort,
-									},
-									RetryPolicy: retryPolicyFromService(svc),
-								},
+								Route: routeAction,
 							},
-						}},
+						}),
 					},
 				},
 			}
 
 			manager, _ := anypb.New(&managerv3.HttpConnectionManager{
-				HttpFilters: []*managerv3.HttpFilter{
-					{
-						Name: wellknown.Router,
-						ConfigType: &managerv3.HttpFilter_TypedConfig{
-							TypedConfig: router,
-						},
+				HttpFilters: append(slices.Clip(httpFilters), &managerv3.HttpFilter{
+					Name: wellknown.Router,
+					ConfigType: &managerv3.HttpFilter_TypedConfig{
+						TypedConfig: router,
 					},
-				},
+				}),
 				RouteSpecifier: &managerv3.HttpConnectionManager_RouteConfig{
 					RouteConfig: routeConfig,
 				},
@@ -155,6 +174,9 @@ func kubeServicesToResources(services []*corev1.Service) []types.Resource {
 				Name:                 targetHostPort,
 				ClusterDiscoveryType: &clusterv3.Cluster_Type{Type: clusterv3.Cluster_EDS},
 				LbPolicy:             clusterv3.Cluster_ROUND_ROBIN,
+				OutlierDetection:     outlierDetectionFromService(svc),
+				CircuitBreakers:      circuitBreakersFromService(svc),
+				TransportSocket:      mtls.transportSocketFromService(svc),
 				EdsClusterConfig: &clusterv3.Cluster_EdsClusterConfig{
 					EdsConfig: &corev3.ConfigSource{
 						ConfigSourceSpecifier: &corev3.ConfigSource_Ads{
@@ -163,8 +185,24 @@ func kubeServicesToResources(services []*corev1.Service) []types.Resource {
 					},
 				},
 			}
+			if !applyExternalName(svc, port, svcCluster) {
+				continue
+			}
+			if statefulSession != nil {
+				svcCluster.CommonLbConfig = sessionOverrideHostStatus()
+			}
+			applyRingHash(svc, svcCluster)
+			applyLbPolicy(svc, svcCluster)
 
 			out = append(out, svcListener, routeConfig, svcCluster)
+
+			if failoverCluster != nil {
+				// gRPC picks endpoints of the underlying clusters with the policy of the aggregate cluster
+				failoverCluster.LbPolicy = svcCluster.LbPolicy
+				failoverCluster.LbConfig = svcCluster.LbConfig
+				failoverCluster.LoadBalancingPolicy = svcCluster.LoadBalancingPolicy
+				out = append(out, failoverCluster)
+			}
 		}
 	}
 
@@ -0,0 +1,63 @@
+package snapshot
+
+import (
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// channelIDFilterStateKey is the filter state key of the gRPC channel ID, which is unique to each channel
+const channelIDFilterStateKey = "io.grpc.channel_id"
+
+// hashPolicyFromService return the hash policies of the service's routes
+// It may return nil if the service does not need consistent hashing
+//
+// Services with the hash-header annotation hash by the header. Otherwise, services with ClientIP
+// session affinity hash by channel, so each channel sticks to one endpoint
+// as in gRPC [A42](https://github.com/grpc/proposal/blob/master/A42-xds-ring-hash-lb-policy.md)
+func hashPolicyFromService(service *corev1.Service) []*routev3.RouteAction_HashPolicy {
+	if header, _, ok := hashHeaderFromService(service); ok {
+		return []*routev3.RouteAction_HashPolicy{{
+			PolicySpecifier: &routev3.RouteAction_HashPolicy_Header_{
+				Header: &routev3.RouteAction_HashPolicy_Header{
+					HeaderName: header,
+				},
+			},
+		}}
+	}
+
+	if service.Spec.SessionAffinity != corev1.ServiceAffinityClientIP {
+		return nil
+	}
+
+	return []*routev3.RouteAction_HashPolicy{{
+		PolicySpecifier: &routev3.RouteAction_HashPolicy_FilterState_{
+			FilterState: &routev3.RouteAction_HashPolicy_FilterState{
+				Key: channelIDFilterStateKey,
+			},
+		},
+	}}
+}
+
+// applyRingHash set the cluster to ring hash if the service has the hash-header annotation or ClientIP session affinity.
+// It should be applied before applyLbPolicy, so that the lb-policy annotation takes precedence
+func applyRingHash(service *corev1.Service, cluster *clusterv3.Cluster) {
+	_, ringHash, ok := hashHeaderFromService(service)
+	if !ok {
+		if service.Spec.SessionAffinity != corev1.ServiceAffinityClientIP {
+			return
+		}
+
+		var err error
+		ringHash, err = ringHashLbPolicy("")
+		if err != nil {
+			klog.ErrorS(err, "cannot build session affinity lb policy", "object", klog.KObj(service))
+			return
+		}
+	}
+
+	cluster.LbPolicy = ringHash.LbPolicy
+	cluster.LbConfig = ringHash.LbConfig
+	cluster.LoadBalancingPolicy = ringHash.LoadBalancingPolicy
+}
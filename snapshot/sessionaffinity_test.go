@@ -0,0 +1,42 @@
+package snapshot
+
+import (
+	"testing"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_sessionAffinity(t *testing.T) {
+	newService := func(sessionAffinity corev1.ServiceAffinity, annotations map[string]string) *corev1.Service {
+		out := newTestService(annotations)
+		out.Spec.SessionAffinity = sessionAffinity
+		return out
+	}
+
+	service := newService(corev1.ServiceAffinityNone, nil)
+	cluster := &clusterv3.Cluster{LbPolicy: clusterv3.Cluster_ROUND_ROBIN}
+	applyRingHash(service, cluster)
+	assert.Equal(t, clusterv3.Cluster_ROUND_ROBIN, cluster.LbPolicy)
+	assert.Nil(t, hashPolicyFromService(service))
+
+	service = newService(corev1.ServiceAffinityClientIP, nil)
+	applyRingHash(service, cluster)
+	assert.Equal(t, clusterv3.Cluster_RING_HASH, cluster.LbPolicy)
+	require.NotNil(t, cluster.LoadBalancingPolicy)
+	assert.Equal(t, "envoy.extensions.load_balancing_policies.ring_hash.v3.RingHash", cluster.LoadBalancingPolicy.Policies[0].TypedExtensionConfig.Name)
+	hashPolicy := hashPolicyFromService(service)
+	require.Len(t, hashPolicy, 1)
+	assert.Equal(t, "io.grpc.channel_id", hashPolicy[0].GetFilterState().GetKey())
+
+	// The lb-policy annotation takes precedence
+	service = newService(corev1.ServiceAffinityClientIP, map[string]string{
+		AnnotationLbPolicy: LbPolicyLeastRequest,
+	})
+	cluster = &clusterv3.Cluster{LbPolicy: clusterv3.Cluster_ROUND_ROBIN}
+	applyRingHash(service, cluster)
+	applyLbPolicy(service, cluster)
+	assert.Equal(t, clusterv3.Cluster_LEAST_REQUEST, cluster.LbPolicy)
+}
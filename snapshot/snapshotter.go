@@ -2,16 +2,18 @@ package snapshot
 
 import (
 	"context"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/log"
-	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 	"github.com/wongnai/xds/meter"
 	"go.opentelemetry.io/otel/metric"
 	"golang.org/x/sync/errgroup"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog/v2"
 )
@@ -31,70 +33,84 @@ var Logger log.Logger = &log.LoggerFuncs{
 	},
 }
 
-func mapTypeURL(typeURL string) string {
-	switch typeURL {
-	case resource.ListenerType, resource.RouteType, resource.ClusterType:
-		return "services"
-	case resource.EndpointType:
-		return "endpoints"
-	default:
-		return ""
-	}
-}
-
 type Snapshotter struct {
 	ResyncPeriod time.Duration
 
-	client         kubernetes.Interface
-	servicesCache  cache.SnapshotCache
-	endpointsCache cache.SnapshotCache
-	muxCache       cache.MuxCache
+	legacyEndpoints   bool
+	watchNodeTopology bool
+	scope             Scope
+	mtls              MTLS
 
+	client kubernetes.Interface
+	cache  nodeGroupCache
+	// versionPrefix is unique to this process, so that versions acknowledged to other instances are never mistaken as current
+	versionPrefix string
+
+	endpointsLock           sync.Mutex
 	endpointResourceCache   map[string]endpointCacheItem
+	headlessServices        map[string]struct{}
+	endpointsRefresher      func()
+	nodeTopologyLock        sync.RWMutex
+	nodeTopology            map[string]locality
 	resourcesByTypeLock     sync.RWMutex
 	serviceResourcesByType  map[string][]types.Resource
 	endpointResourcesByType map[string][]types.Resource
 	apiGatewayStats         map[string]int
 	kubeEventCounter        metric.Int64Counter
+
+	groupsLock        sync.Mutex
+	groups            map[string]*groupState
+	groupsCreated     uint64
+	services          []*corev1.Service
+	servicesVersion   string
+	servicesSynced    bool
+	endpointResources map[string][]types.Resource
+	serviceEndpoints  map[string]*serviceEndpoints
+	endpointsVersion  string
+	endpointsSynced   bool
+	// serverListenerCache is the server Listeners by service namespace/name
+	serverListenerCache map[string]serverListenerCacheItem
+	// podServiceCache is the resources of the pod services by headless service namespace/name
+	podServiceCache map[string]podServiceCacheItem
 }
 
-func New(client kubernetes.Interface) *Snapshotter {
-	servicesCache := cache.NewSnapshotCache(false, EmptyNodeID{}, Logger)
-	endpointsCache := cache.NewSnapshotCache(false, EmptyNodeID{}, Logger)
-	muxCache := cache.MuxCache{
-		Classify: func(r *cache.Request) string {
-			return mapTypeURL(r.TypeUrl)
-		},
-		ClassifyDelta: func(r *cache.DeltaRequest) string {
-			return mapTypeURL(r.TypeUrl)
-		},
-		Caches: map[string]cache.Cache{
-			"services":  servicesCache,
-			"endpoints": endpointsCache,
-		},
-	}
+type Option func(s *Snapshotter)
+
+func New(client kubernetes.Interface, opts ...Option) *Snapshotter {
+	versionPrefix := strconv.FormatInt(time.Now().UnixNano(), 36) + "-"
 
 	ss := &Snapshotter{
 		ResyncPeriod: 10 * time.Minute,
 
-		client:         client,
-		servicesCache:  servicesCache,
-		endpointsCache: endpointsCache,
-		muxCache:       muxCache,
+		watchNodeTopology: true,
+
+		client:        client,
+		versionPrefix: versionPrefix,
 
 		endpointResourceCache: map[string]endpointCacheItem{},
+
+		groups: map[string]*groupState{
+			GlobalNodeGroup: newGroupState(versionPrefix),
+		},
+	}
+	ss.cache = nodeGroupCache{snapshotter: ss}
+
+	for _, o := range opts {
+		o(ss)
 	}
 
 	meter := meter.GetMeter()
 	ss.kubeEventCounter, _ = meter.Int64Counter("xds_kube_events")
 	meter.Int64ObservableGauge("xds_snapshot_resources", metric.WithInt64Callback(ss.snapshotResourceGaugeCallback))
 	meter.Int64ObservableGauge("xds_apigateway_endpoints", metric.WithInt64Callback(ss.apiGatewayEndpointGaugeCallback))
+	meter.Int64ObservableGauge("xds_scope", metric.WithInt64Callback(ss.scopeGaugeCallback))
 
 	return ss
 }
 
-func (s *Snapshotter) MuxCache() *cache.MuxCache {
-	return &s.muxCache
+// Cache return the xDS cache serving both state of the world and delta watches
+func (s *Snapshotter) Cache() cache.Cache {
+	return s.cache
 }
 
 func (s *Snapshotter) Start(stopCtx context.Context) error {
@@ -103,8 +119,16 @@ func (s *Snapshotter) Start(stopCtx context.Context) error {
 		return s.startServices(groupCtx)
 	})
 	group.Go(func() error {
-		return s.startEndpoints(groupCtx)
+		if s.legacyEndpoints {
+			return s.startEndpoints(groupCtx)
+		}
+		return s.startEndpointSlices(groupCtx)
 	})
+	if s.watchNodeTopology {
+		group.Go(func() error {
+			return s.startNodes(groupCtx)
+		})
+	}
 	return group.Wait()
 }
 
@@ -125,6 +149,22 @@ func (s *Snapshotter) apiGatewayEndpointGaugeCallback(_ context.Context, result
 	return nil
 }
 
+// scopeGaugeCallback report the active scope as attributes of a constant gauge
+func (s *Snapshotter) scopeGaugeCallback(_ context.Context, result metric.Int64Observer) error {
+	result.Observe(1, metric.WithAttributes(
+		meter.ScopeNamespacesAttrKey.String(strings.Join(s.scope.Namespaces, ",")),
+		meter.ScopeExcludeNamespacesAttrKey.String(strings.Join(s.scope.ExcludeNamespaces, ",")),
+		meter.ScopeLabelSelectorAttrKey.String(s.scope.LabelSelector),
+		meter.ScopeFieldSelectorAttrKey.String(s.scope.FieldSelector),
+	))
+	return nil
+}
+
+// Scope return the active scope
+func (s *Snapshotter) Scope() Scope {
+	return s.scope
+}
+
 func (s *Snapshotter) setServiceResourcesByType(serviceResourcesByType map[string][]types.Resource) {
 	s.resourcesByTypeLock.Lock()
 	defer s.resourcesByTypeLock.Unlock()
@@ -160,3 +200,33 @@ func (s *Snapshotter) getAPIGatewayStats() map[string]int {
 	defer s.resourcesByTypeLock.RUnlock()
 	return s.apiGatewayStats
 }
+
+// WithLegacyEndpoints source endpoints from the deprecated core/v1 Endpoints API instead of EndpointSlices
+// for clusters that do not serve discovery.k8s.io/v1
+func WithLegacyEndpoints(legacyEndpoints bool) Option {
+	return func(s *Snapshotter) {
+		s.legacyEndpoints = legacyEndpoints
+	}
+}
+
+// WithNodeTopology watch Kubernetes nodes for their topology labels to build endpoint localities.
+// When disabled, only the zone reported in EndpointSlices is used
+func WithNodeTopology(enabled bool) Option {
+	return func(s *Snapshotter) {
+		s.watchNodeTopology = enabled
+	}
+}
+
+// WithScope limit the watched Services and Endpoints to the scope
+func WithScope(scope Scope) Option {
+	return func(s *Snapshotter) {
+		s.scope = scope
+	}
+}
+
+// WithMTLS configure mutual TLS between xDS clients and services
+func WithMTLS(mtls MTLS) Option {
+	return func(s *Snapshotter) {
+		s.mtls = mtls
+	}
+}
@@ -0,0 +1,101 @@
+package snapshot
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	statefulsessionv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/stateful_session/v3"
+	cookiev3 "github.com/envoyproxy/go-control-plane/envoy/extensions/http/stateful_session/cookie/v3"
+	httpv3 "github.com/envoyproxy/go-control-plane/envoy/type/http/v3"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// AnnotationSessionCookie enable stateful session with the cookie name, optionally followed by
+// comma-separated key=value parameters. For example, "session,path=/,ttl=1h"
+const AnnotationSessionCookie = "xds.lmwn.com/session-cookie"
+
+// statefulSessionFilterName is the name of the stateful session HTTP filter
+const statefulSessionFilterName = "envoy.filters.http.stateful_session"
+
+// statefulSessionFromService convert annotations on the Kubernetes service to stateful session
+// It may return nil if not configured or the annotation is invalid
+//
+// The supported values are as in gRPC [A55](https://github.com/grpc/proposal/blob/master/A55-xds-stateful-session-affinity.md)
+func statefulSessionFromService(service *corev1.Service) *statefulsessionv3.StatefulSession {
+	sessionCookie, ok := service.GetAnnotations()[AnnotationSessionCookie]
+	if !ok {
+		return nil
+	}
+
+	cookie, err := parseSessionCookie(sessionCookie)
+	if err != nil {
+		klog.ErrorS(err, "cannot parse session-cookie", "object", klog.KObj(service), "session-cookie", sessionCookie)
+		return nil
+	}
+
+	sessionState, _ := anypb.New(&cookiev3.CookieBasedSessionState{
+		Cookie: cookie,
+	})
+	return &statefulsessionv3.StatefulSession{
+		SessionState: &corev3.TypedExtensionConfig{
+			Name:        "envoy.http.stateful_session.cookie",
+			TypedConfig: sessionState,
+		},
+	}
+}
+
+// sessionOverrideHostStatus is the endpoint health status that sessions can stick to.
+// Draining endpoints are included so sessions can finish on terminating pods
+func sessionOverrideHostStatus() *clusterv3.Cluster_CommonLbConfig {
+	return &clusterv3.Cluster_CommonLbConfig{
+		OverrideHostStatus: &corev3.HealthStatusSet{
+			Statuses: []corev3.HealthStatus{
+				corev3.HealthStatus_UNKNOWN,
+				corev3.HealthStatus_HEALTHY,
+				corev3.HealthStatus_DRAINING,
+			},
+		},
+	}
+}
+
+func parseSessionCookie(v string) (*httpv3.Cookie, error) {
+	name, rawParams, _ := strings.Cut(v, ",")
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("cookie name is required")
+	}
+	if strings.ContainsAny(name, " \t;,=\"") {
+		return nil, fmt.Errorf("invalid cookie name %q", name)
+	}
+
+	params, err := parseParams(rawParams)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &httpv3.Cookie{Name: name}
+	if path, ok := params["path"]; ok {
+		delete(params, "path")
+		out.Path = path
+	}
+	if ttl, ok := params["ttl"]; ok {
+		delete(params, "ttl")
+		parsed, err := parseNonNegativeDuration(ttl)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse ttl: %w", err)
+		}
+		out.Ttl = durationpb.New(parsed)
+	}
+
+	if len(params) > 0 {
+		return nil, fmt.Errorf("unknown parameters %v", slices.Sorted(maps.Keys(params)))
+	}
+	return out, nil
+}
@@ -0,0 +1,76 @@
+package snapshot
+
+import (
+	"testing"
+	"time"
+
+	cookiev3 "github.com/envoyproxy/go-control-plane/envoy/extensions/http/stateful_session/cookie/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseSessionCookie(t *testing.T) {
+	for _, testcase := range []struct {
+		Input      string
+		ExpectName string
+		ExpectPath string
+		ExpectTTL  time.Duration
+		ExpectErr  bool
+	}{
+		{
+			Input:      "session",
+			ExpectName: "session",
+		},
+		{
+			Input:      "session, path=/, ttl=1h",
+			ExpectName: "session",
+			ExpectPath: "/",
+			ExpectTTL:  time.Hour,
+		},
+		{
+			Input:     "",
+			ExpectErr: true,
+		},
+		{
+			Input:     "bad;name",
+			ExpectErr: true,
+		},
+		{
+			Input:     "session,ttl=-1h",
+			ExpectErr: true,
+		},
+		{
+			Input:     "session,domain=example.com",
+			ExpectErr: true,
+		},
+	} {
+		t.Run(testcase.Input, func(t *testing.T) {
+			out, err := parseSessionCookie(testcase.Input)
+			if testcase.ExpectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testcase.ExpectName, out.Name)
+			assert.Equal(t, testcase.ExpectPath, out.Path)
+			assert.Equal(t, testcase.ExpectTTL, out.GetTtl().AsDuration())
+		})
+	}
+}
+
+func Test_statefulSessionFromService(t *testing.T) {
+	assert.Nil(t, statefulSessionFromService(newTestService(nil)))
+	assert.Nil(t, statefulSessionFromService(newTestService(map[string]string{
+		AnnotationSessionCookie: "",
+	})))
+
+	out := statefulSessionFromService(newTestService(map[string]string{
+		AnnotationSessionCookie: "session,path=/",
+	}))
+	require.NotNil(t, out)
+	assert.Equal(t, "envoy.http.stateful_session.cookie", out.SessionState.Name)
+	state := &cookiev3.CookieBasedSessionState{}
+	require.NoError(t, out.SessionState.TypedConfig.UnmarshalTo(state))
+	assert.Equal(t, "session", state.Cookie.Name)
+	assert.Equal(t, "/", state.Cookie.Path)
+}
@@ -0,0 +1,46 @@
+package snapshot
+
+import (
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"google.golang.org/protobuf/types/known/durationpb"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const AnnotationTimeout = "xds.lmwn.com/timeout"
+const AnnotationMaxStreamDuration = "xds.lmwn.com/max-stream-duration"
+
+// maxStreamDurationFromService convert annotations on the Kubernetes service to xDS route timeout
+// It may return nil if not configured
+//
+// The supported values are as in gRPC [A31](https://github.com/grpc/proposal/blob/master/A31-xds-timeout-support-and-config-selector.md).
+// The client's deadline is capped to the timeout, and a zero duration disables the cap
+func maxStreamDurationFromService(service *corev1.Service) *routev3.RouteAction_MaxStreamDuration {
+	annotations := service.GetAnnotations()
+	out := &routev3.RouteAction_MaxStreamDuration{}
+
+	timeout, ok := annotations[AnnotationTimeout]
+	if ok {
+		parsed, err := parseNonNegativeDuration(timeout)
+		if err == nil {
+			out.GrpcTimeoutHeaderMax = durationpb.New(parsed)
+		} else {
+			klog.ErrorS(err, "cannot parse timeout", "object", klog.KObj(service), "timeout", timeout)
+		}
+	}
+
+	maxStreamDuration, ok := annotations[AnnotationMaxStreamDuration]
+	if ok {
+		parsed, err := parseNonNegativeDuration(maxStreamDuration)
+		if err == nil {
+			out.MaxStreamDuration = durationpb.New(parsed)
+		} else {
+			klog.ErrorS(err, "cannot parse max-stream-duration", "object", klog.KObj(service), "max-stream-duration", maxStreamDuration)
+		}
+	}
+
+	if out.GrpcTimeoutHeaderMax == nil && out.MaxStreamDuration == nil {
+		return nil
+	}
+	return out
+}
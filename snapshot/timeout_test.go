@@ -0,0 +1,31 @@
+package snapshot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_maxStreamDurationFromService(t *testing.T) {
+	assert.Nil(t, maxStreamDurationFromService(newTestService(nil)))
+	assert.Nil(t, maxStreamDurationFromService(newTestService(map[string]string{
+		AnnotationTimeout: "invalid",
+	})))
+
+	out := maxStreamDurationFromService(newTestService(map[string]string{
+		AnnotationTimeout:           "5s",
+		AnnotationMaxStreamDuration: "-1m",
+	}))
+	require.NotNil(t, out)
+	assert.Equal(t, 5*time.Second, out.GrpcTimeoutHeaderMax.AsDuration())
+	assert.Nil(t, out.MaxStreamDuration)
+
+	out = maxStreamDurationFromService(newTestService(map[string]string{
+		AnnotationMaxStreamDuration: "1m",
+	}))
+	require.NotNil(t, out)
+	assert.Nil(t, out.GrpcTimeoutHeaderMax)
+	assert.Equal(t, time.Minute, out.MaxStreamDuration.AsDuration())
+}
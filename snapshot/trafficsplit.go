@@ -0,0 +1,112 @@
+package snapshot
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// AnnotationTrafficSplit is a comma-separated list of service=weight in the same namespace to split the traffic to.
+// For example, "foo-v2=10,foo=90"
+const AnnotationTrafficSplit = "xds.lmwn.com/traffic-split"
+
+type trafficSplitTarget struct {
+	Service string
+	Weight  uint32
+}
+
+// servicesByName index services by namespace/name
+func servicesByName(services []*corev1.Service) map[string]*corev1.Service {
+	out := make(map[string]*corev1.Service, len(services))
+	for _, svc := range services {
+		out[svc.Namespace+"/"+svc.Name] = svc
+	}
+	return out
+}
+
+// weightedClustersFromService convert the traffic split annotation on the Kubernetes service to weighted clusters
+// of the port. It may return nil if not configured, or if any target service or its port is not known
+//
+// The supported values are as in gRPC [A28](https://github.com/grpc/proposal/blob/master/A28-xds-traffic-splitting-and-routing.md)
+func weightedClustersFromService(service *corev1.Service, port corev1.ServicePort, services map[string]*corev1.Service) *routev3.WeightedCluster {
+	trafficSplit, ok := service.GetAnnotations()[AnnotationTrafficSplit]
+	if !ok {
+		return nil
+	}
+
+	targets, err := parseTrafficSplit(trafficSplit)
+	if err != nil {
+		klog.ErrorS(err, "cannot parse traffic-split", "object", klog.KObj(service), "traffic-split", trafficSplit)
+		return nil
+	}
+
+	out := &routev3.WeightedCluster{}
+	for _, target := range targets {
+		cluster, err := serviceCluster(service.Namespace, target.Service, port.Name, services)
+		if err != nil {
+			klog.ErrorS(err, "invalid traffic-split", "object", klog.KObj(service), "traffic-split", trafficSplit)
+			return nil
+		}
+		out.Clusters = append(out.Clusters, &routev3.WeightedCluster_ClusterWeight{
+			Name:   cluster,
+			Weight: wrapperspb.UInt32(target.Weight),
+		})
+	}
+	return out
+}
+
+// serviceCluster return the cluster name of the named port of a known service
+func serviceCluster(namespace string, name string, portName string, services map[string]*corev1.Service) (string, error) {
+	svc, ok := services[namespace+"/"+name]
+	if !ok {
+		return "", fmt.Errorf("service %s/%s not found", namespace, name)
+	}
+	for _, port := range svc.Spec.Ports {
+		if port.Name == portName {
+			return net.JoinHostPort(fmt.Sprintf("%s.%s", svc.Name, svc.Namespace), port.Name), nil
+		}
+	}
+	return "", fmt.Errorf("service %s/%s has no port named %q", namespace, name, portName)
+}
+
+func parseTrafficSplit(v string) ([]trafficSplitTarget, error) {
+	var out []trafficSplitTarget
+	var total uint64
+	seen := map[string]bool{}
+
+	for _, entry := range strings.Split(v, ",") {
+		name, weight, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("entry %q is not in service=weight form", entry)
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("entry %q has no service", entry)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("service %s is listed more than once", name)
+		}
+		seen[name] = true
+
+		parsed, err := strconv.ParseUint(strings.TrimSpace(weight), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse weight of %s: %w", name, err)
+		}
+		total += parsed
+		out = append(out, trafficSplitTarget{Service: name, Weight: uint32(parsed)})
+	}
+
+	if total == 0 {
+		return nil, fmt.Errorf("total weight must be greater than 0")
+	}
+	if total > 0xFFFFFFFF {
+		return nil, fmt.Errorf("total weight must fit in uint32")
+	}
+	return out, nil
+}
@@ -0,0 +1,110 @@
+package snapshot
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_parseTrafficSplit(t *testing.T) {
+	for _, testcase := range []struct {
+		Input     string
+		Expect    []trafficSplitTarget
+		ExpectErr bool
+	}{
+		{
+			Input:  "foo-v2=10,foo=90",
+			Expect: []trafficSplitTarget{{Service: "foo-v2", Weight: 10}, {Service: "foo", Weight: 90}},
+		},
+		{
+			Input:  " foo-v2 = 0 , foo = 1 ",
+			Expect: []trafficSplitTarget{{Service: "foo-v2", Weight: 0}, {Service: "foo", Weight: 1}},
+		},
+		{
+			Input:     "",
+			ExpectErr: true,
+		},
+		{
+			Input:     "foo",
+			ExpectErr: true,
+		},
+		{
+			Input:     "=10",
+			ExpectErr: true,
+		},
+		{
+			Input:     "foo=-1",
+			ExpectErr: true,
+		},
+		{
+			Input:     "foo=0,bar=0",
+			ExpectErr: true,
+		},
+		{
+			Input:     "foo=1,foo=2",
+			ExpectErr: true,
+		},
+		{
+			Input:     "foo=4294967295,bar=1",
+			ExpectErr: true,
+		},
+	} {
+		t.Run(testcase.Input, func(t *testing.T) {
+			out, err := parseTrafficSplit(testcase.Input)
+			if testcase.ExpectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, testcase.Expect, out)
+		})
+	}
+}
+
+func Test_weightedClustersFromService(t *testing.T) {
+	service := func(name string, namespace string, annotations map[string]string, ports ...string) *corev1.Service {
+		out := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   namespace,
+				Annotations: annotations,
+			},
+		}
+		for _, port := range ports {
+			out.Spec.Ports = append(out.Spec.Ports, corev1.ServicePort{Name: port})
+		}
+		return out
+	}
+
+	services := servicesByName([]*corev1.Service{
+		service("foo", "default", nil, "grpc", "http"),
+		service("foo-v2", "default", nil, "grpc"),
+		service("bar", "other", nil, "grpc"),
+	})
+	port := corev1.ServicePort{Name: "grpc"}
+
+	out := weightedClustersFromService(service("foo", "default", map[string]string{
+		AnnotationTrafficSplit: "foo-v2=10,foo=90",
+	}), port, services)
+	require.NotNil(t, out)
+	require.Len(t, out.Clusters, 2)
+	assert.Equal(t, "foo-v2.default:grpc", out.Clusters[0].Name)
+	assert.Equal(t, uint32(10), out.Clusters[0].Weight.GetValue())
+	assert.Equal(t, "foo.default:grpc", out.Clusters[1].Name)
+	assert.Equal(t, uint32(90), out.Clusters[1].Weight.GetValue())
+
+	assert.Nil(t, weightedClustersFromService(service("foo", "default", nil), port, services))
+
+	// Services in other namespaces are not reachable
+	assert.Nil(t, weightedClustersFromService(service("foo", "default", map[string]string{
+		AnnotationTrafficSplit: "bar=10,foo=90",
+	}), port, services))
+
+	// The target must have the same port name
+	assert.Nil(t, weightedClustersFromService(service("foo", "default", map[string]string{
+		AnnotationTrafficSplit: "foo-v2=10,foo=90",
+	}), corev1.ServicePort{Name: "http"}, services))
+}
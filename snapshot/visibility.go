@@ -0,0 +1,52 @@
+package snapshot
+
+import (
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// AnnotationVisibility is a comma-separated list of namespaces and visibility groups that may see the service.
+// The value "*" makes the service visible to everyone, which is the default when the annotation is missing
+const AnnotationVisibility = "xds.lmwn.com/visibility"
+
+// serviceVisibleTo return whether the service should be published to nodes of the group
+//
+// Services are always visible to the global group and to nodes in the service's own namespace
+func serviceVisibleTo(service *corev1.Service, group nodeGroup) bool {
+	if group == (nodeGroup{}) {
+		return true
+	}
+	visibility, ok := service.Annotations[AnnotationVisibility]
+	if !ok {
+		return true
+	}
+	if group.Namespace == service.Namespace {
+		return true
+	}
+
+	for _, entry := range strings.Split(visibility, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if entry == "*" || entry == group.Group || entry == group.Namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// visibleServices filter services visible to nodes of the group
+func visibleServices(services []*corev1.Service, group nodeGroup) []*corev1.Service {
+	if group == (nodeGroup{}) {
+		return services
+	}
+	out := make([]*corev1.Service, 0, len(services))
+	for _, svc := range services {
+		if serviceVisibleTo(svc, group) {
+			out = append(out, svc)
+		}
+	}
+	return out
+}
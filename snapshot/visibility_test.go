@@ -0,0 +1,63 @@
+package snapshot
+
+import (
+	"testing"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/structpb"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestNodeGroup_ID(t *testing.T) {
+	newNode := func(metadata map[string]interface{}) *corev3.Node {
+		s, err := structpb.NewStruct(metadata)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &corev3.Node{Id: "test", Metadata: s}
+	}
+
+	assert.Equal(t, GlobalNodeGroup, NodeGroup{}.ID(nil))
+	assert.Equal(t, GlobalNodeGroup, NodeGroup{}.ID(newNode(nil)))
+	assert.Equal(t, "namespace/default", NodeGroup{}.ID(newNode(map[string]interface{}{
+		NodeMetadataNamespace: "default",
+	})))
+	assert.Equal(t, "group/payments", NodeGroup{}.ID(newNode(map[string]interface{}{
+		NodeMetadataNamespace:       "default",
+		NodeMetadataVisibilityGroup: "payments",
+	})))
+}
+
+func Test_serviceVisibleTo(t *testing.T) {
+	newService := func(visibility *string) *corev1.Service {
+		svc := newTestService(nil)
+		svc.Namespace = "app"
+		if visibility != nil {
+			svc.Annotations = map[string]string{AnnotationVisibility: *visibility}
+		}
+		return svc
+	}
+	restricted := "frontend, payments"
+	public := "*"
+
+	for _, testcase := range []struct {
+		Name       string
+		Visibility *string
+		Group      string
+		Expect     bool
+	}{
+		{Name: "global", Visibility: &restricted, Group: GlobalNodeGroup, Expect: true},
+		{Name: "no annotation", Group: "namespace/other", Expect: true},
+		{Name: "wildcard", Visibility: &public, Group: "namespace/other", Expect: true},
+		{Name: "own namespace", Visibility: &restricted, Group: "namespace/app", Expect: true},
+		{Name: "listed namespace", Visibility: &restricted, Group: "namespace/frontend", Expect: true},
+		{Name: "listed group", Visibility: &restricted, Group: "group/payments", Expect: true},
+		{Name: "unlisted namespace", Visibility: &restricted, Group: "namespace/other", Expect: false},
+		{Name: "unlisted group", Visibility: &restricted, Group: "group/app", Expect: false},
+	} {
+		t.Run(testcase.Name, func(t *testing.T) {
+			assert.Equal(t, testcase.Expect, serviceVisibleTo(newService(testcase.Visibility), nodeGroupFromID(testcase.Group)))
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package snapshot
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	cswrrv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/load_balancing_policies/client_side_weighted_round_robin/v3"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const AnnotationWrrBlackoutPeriod = "xds.lmwn.com/wrr-blackout-period"
+const AnnotationWrrWeightExpirationPeriod = "xds.lmwn.com/wrr-weight-expiration-period"
+const AnnotationWrrWeightUpdatePeriod = "xds.lmwn.com/wrr-weight-update-period"
+const AnnotationWrrOobReportingPeriod = "xds.lmwn.com/wrr-oob-reporting-period"
+const AnnotationWrrErrorUtilizationPenalty = "xds.lmwn.com/wrr-error-utilization-penalty"
+
+// applyWeightedRoundRobin convert annotations on the Kubernetes service to client side weighted round robin settings.
+// Invalid values are ignored and the client defaults are used
+//
+// The supported values are as in gRPC [A58](https://github.com/grpc/proposal/blob/master/A58-client-side-weighted-round-robin-lb-policy.md)
+func applyWeightedRoundRobin(service *corev1.Service, out *cswrrv3.ClientSideWeightedRoundRobin) {
+	annotations := service.GetAnnotations()
+
+	durations := []struct {
+		annotation string
+		target     **durationpb.Duration
+	}{
+		{AnnotationWrrBlackoutPeriod, &out.BlackoutPeriod},
+		{AnnotationWrrWeightExpirationPeriod, &out.WeightExpirationPeriod},
+		{AnnotationWrrWeightUpdatePeriod, &out.WeightUpdatePeriod},
+		{AnnotationWrrOobReportingPeriod, &out.OobReportingPeriod},
+	}
+	for _, duration := range durations {
+		value, ok := annotations[duration.annotation]
+		if !ok {
+			continue
+		}
+		parsed, err := parseNonNegativeDuration(value)
+		if err != nil {
+			klog.ErrorS(err, "cannot parse duration", "object", klog.KObj(service), "annotation", duration.annotation, "value", value)
+			continue
+		}
+		*duration.target = durationpb.New(parsed)
+	}
+
+	// Backends only stream ORCA load reports when asked to
+	if out.OobReportingPeriod != nil {
+		out.EnableOobLoadReport = wrapperspb.Bool(true)
+	}
+
+	errorUtilizationPenalty, ok := annotations[AnnotationWrrErrorUtilizationPenalty]
+	if ok {
+		parsed, err := strconv.ParseFloat(errorUtilizationPenalty, 32)
+		if err == nil && parsed < 0 {
+			err = fmt.Errorf("must not be negative")
+		}
+		if err == nil {
+			out.ErrorUtilizationPenalty = wrapperspb.Float(float32(parsed))
+		} else {
+			klog.ErrorS(err, "cannot parse wrr-error-utilization-penalty", "object", klog.KObj(service), "wrr-error-utilization-penalty", errorUtilizationPenalty)
+		}
+	}
+}
+
+// weightedRoundRobinAnnotations return the weighted round robin annotations set on the service
+func weightedRoundRobinAnnotations(service *corev1.Service) []string {
+	var out []string
+	for _, annotation := range []string{
+		AnnotationWrrBlackoutPeriod,
+		AnnotationWrrWeightExpirationPeriod,
+		AnnotationWrrWeightUpdatePeriod,
+		AnnotationWrrOobReportingPeriod,
+		AnnotationWrrErrorUtilizationPenalty,
+	} {
+		if _, ok := service.GetAnnotations()[annotation]; ok {
+			out = append(out, annotation)
+		}
+	}
+	return out
+}
+
+// logUnusedWeightedRoundRobin log an error if the service has weighted round robin annotations
+// but another lb-policy, as the annotations have no effect
+func logUnusedWeightedRoundRobin(service *corev1.Service) {
+	if annotations := weightedRoundRobinAnnotations(service); len(annotations) > 0 {
+		err := fmt.Errorf("lb-policy is not %s", LbPolicyWeightedRoundRobin)
+		klog.ErrorS(err, "weighted round robin annotations are ignored", "object", klog.KObj(service), "annotations", annotations)
+	}
+}
+
+func parseNonNegativeDuration(v string) (time.Duration, error) {
+	parsed, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, err
+	}
+	if parsed < 0 {
+		return 0, fmt.Errorf("duration must not be negative")
+	}
+	return parsed, nil
+}
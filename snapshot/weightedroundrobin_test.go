@@ -0,0 +1,47 @@
+package snapshot
+
+import (
+	"testing"
+	"time"
+
+	cswrrv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/load_balancing_policies/client_side_weighted_round_robin/v3"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func Test_applyWeightedRoundRobin(t *testing.T) {
+	out := &cswrrv3.ClientSideWeightedRoundRobin{}
+	applyWeightedRoundRobin(newTestService(map[string]string{
+		AnnotationWrrBlackoutPeriod:          "5s",
+		AnnotationWrrWeightExpirationPeriod:  "invalid",
+		AnnotationWrrWeightUpdatePeriod:      "-1s",
+		AnnotationWrrOobReportingPeriod:      "2s",
+		AnnotationWrrErrorUtilizationPenalty: "1.5",
+	}), out)
+
+	assert.Equal(t, 5*time.Second, out.BlackoutPeriod.AsDuration())
+	assert.Nil(t, out.WeightExpirationPeriod)
+	assert.Nil(t, out.WeightUpdatePeriod)
+	assert.Equal(t, 2*time.Second, out.OobReportingPeriod.AsDuration())
+	assert.True(t, out.EnableOobLoadReport.GetValue())
+	assert.InDelta(t, 1.5, out.ErrorUtilizationPenalty.GetValue(), 0.001)
+}
+
+func Test_applyWeightedRoundRobin_default(t *testing.T) {
+	out := &cswrrv3.ClientSideWeightedRoundRobin{}
+	applyWeightedRoundRobin(&corev1.Service{}, out)
+
+	assert.Nil(t, out.EnableOobLoadReport)
+	assert.Nil(t, out.BlackoutPeriod)
+}
+
+func Test_weightedRoundRobinAnnotations(t *testing.T) {
+	assert.Empty(t, weightedRoundRobinAnnotations(newTestService(map[string]string{
+		AnnotationLbPolicy: LbPolicyRoundRobin,
+	})))
+	assert.Equal(t, []string{AnnotationWrrBlackoutPeriod, AnnotationWrrErrorUtilizationPenalty}, weightedRoundRobinAnnotations(newTestService(map[string]string{
+		AnnotationLbPolicy:                   LbPolicyRoundRobin,
+		AnnotationWrrBlackoutPeriod:          "5s",
+		AnnotationWrrErrorUtilizationPenalty: "1",
+	})))
+}
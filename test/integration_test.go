@@ -1,26 +1,41 @@
 package test_test
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net"
+	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 	"github.com/wongnai/xds/internal/di"
+	"github.com/wongnai/xds/snapshot"
 	"github.com/wongnai/xds/snapshot/apigateway"
 	"github.com/wongnai/xds/test"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	xdscreds "google.golang.org/grpc/credentials/xds"
 	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"google.golang.org/grpc/xds"
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/kubernetes/fake"
 	"k8s.io/klog/v2"
+	"k8s.io/utils/ptr"
 )
 
 // xdsServerBind is where the xDS Server is listening. Since the port is :0, use s.listener.Addr().String() to get the actual address
@@ -34,7 +49,12 @@ type XdsIntegrationTestSuite struct {
 	kube               *fake.Clientset
 	activeFakeServices []*test.FakeService
 
-	fakeServiceIP uint8
+	fakeServiceIP   uint8
+	legacyEndpoints bool
+
+	certificateAuthority *test.CertificateAuthority
+	// certificateDir contains the clients' certificate for the file_watcher certificate provider
+	certificateDir string
 }
 
 func (s *XdsIntegrationTestSuite) SetupSuite() {
@@ -42,6 +62,13 @@ func (s *XdsIntegrationTestSuite) SetupSuite() {
 	s.Require().NoError(err)
 	s.listener = listener
 
+	s.certificateAuthority, err = test.NewCertificateAuthority()
+	s.Require().NoError(err)
+	s.certificateDir, err = os.MkdirTemp("", "xds-test-certs")
+	s.Require().NoError(err)
+	err = s.certificateAuthority.IssueFiles(s.certificateDir, "spiffe://cluster.local/ns/default/sa/client")
+	s.Require().NoError(err)
+
 	go func() {
 		err := s.TestServer.GrpcServer.Serve(listener)
 		if err != nil {
@@ -65,10 +92,32 @@ func (s *XdsIntegrationTestSuite) TearDownTest() {
 func (s *XdsIntegrationTestSuite) TearDownSuite() {
 	s.TestServer.GrpcServer.Stop()
 	s.listener.Close()
+	os.RemoveAll(s.certificateDir)
 }
 
 func (s *XdsIntegrationTestSuite) getClient(target string) grpc_health_v1.HealthClient {
-	xdsBuilder, err := xds.NewXDSResolverWithConfigForTesting([]byte(fmt.Sprintf(`{
+	return s.getClientWithMetadata(target, map[string]string{})
+}
+
+func (s *XdsIntegrationTestSuite) getClientWithMetadata(target string, metadata map[string]string) grpc_health_v1.HealthClient {
+	xdsBuilder, err := xds.NewXDSResolverWithConfigForTesting(s.bootstrap(metadata))
+	s.Require().NoError(err)
+	// Clusters without TLS fall back to plaintext
+	creds, err := xdscreds.NewClientCredentials(xdscreds.ClientOptions{FallbackCreds: insecure.NewCredentials()})
+	s.Require().NoError(err)
+	client, err := grpc.NewClient(target, grpc.WithResolvers(xdsBuilder), grpc.WithTransportCredentials(creds))
+	s.Require().NoError(err)
+
+	healthClient := grpc_health_v1.NewHealthClient(client)
+	return healthClient
+}
+
+// bootstrap return the xDS bootstrap of both clients and servers
+func (s *XdsIntegrationTestSuite) bootstrap(metadata map[string]string) []byte {
+	metadataJSON, err := json.Marshal(metadata)
+	s.Require().NoError(err)
+
+	return []byte(fmt.Sprintf(`{
 		"xds_servers": [{
 			"server_uri": "%s",
 			"channel_creds": [{"type": "insecure"}],
@@ -76,17 +125,24 @@ func (s *XdsIntegrationTestSuite) getClient(target string) grpc_health_v1.Health
 		}],
 		"node": {
 			"id": "test",
+			"metadata": %s,
 			"locality": {
 				"zone" : "test"
 			}
-		}
-	}`, s.listener.Addr().String())))
-	s.Require().NoError(err)
-	client, err := grpc.NewClient(target, grpc.WithResolvers(xdsBuilder), grpc.WithTransportCredentials(insecure.NewCredentials()))
-	s.Require().NoError(err)
-
-	healthClient := grpc_health_v1.NewHealthClient(client)
-	return healthClient
+		},
+		"certificate_providers": {
+			"default": {
+				"plugin_name": "file_watcher",
+				"config": {
+					"certificate_file": "%[3]s/cert.pem",
+					"private_key_file": "%[3]s/key.pem",
+					"ca_certificate_file": "%[3]s/ca.pem",
+					"refresh_interval": "600s"
+				}
+			}
+		},
+		"server_listener_resource_name_template": "%[4]s%%s"
+	}`, s.listener.Addr().String(), metadataJSON, s.certificateDir, snapshot.ServerListenerNamePrefix))
 }
 
 func (s *XdsIntegrationTestSuite) createFakeService(serviceName string, namespace string, port int32, register bool) *test.FakeService {
@@ -118,19 +174,53 @@ func (s *XdsIntegrationTestSuite) createKubeService(serviceName string, namespac
 }
 
 func (s *XdsIntegrationTestSuite) createKubeEndpoint(serviceName string, namespace string, ip string, port int32) {
-	endpoint := &test.K8SEndpoint{
-		Name:      serviceName,
-		Namespace: namespace,
-		IP:        []string{ip},
-		Ports: []corev1.EndpointPort{{
-			Name: "grpc",
-			Port: port,
-		}},
+	s.createKubeEndpoints(serviceName, namespace, []string{ip}, port)
+}
+
+// createKubeEndpoints register endpoints of multiple IPs with the same port
+func (s *XdsIntegrationTestSuite) createKubeEndpoints(serviceName string, namespace string, ips []string, port int32) {
+	s.createKubePodEndpoints(serviceName, namespace, ips, nil, nil, port)
+}
+
+// createKubePodEndpoints register endpoints of multiple IPs with the pods and hostnames at the same index
+func (s *XdsIntegrationTestSuite) createKubePodEndpoints(serviceName string, namespace string, ips []string, pods []string, hostnames []string, port int32) {
+	var err error
+	if s.legacyEndpoints {
+		endpoint := &test.K8SEndpoint{
+			Name:      serviceName,
+			Namespace: namespace,
+			IP:        ips,
+			Hostnames: hostnames,
+			Pods:      pods,
+			Ports: []corev1.EndpointPort{{ //nolint:staticcheck // We use Endpoint to simulate legacy Kube compatibility
+				Name: "grpc",
+				Port: port,
+			}},
+		}
+		err = s.kube.Tracker().Add(endpoint.AsK8S()) //nolint:staticcheck // We use Endpoint to simulate legacy Kube compatibility
+	} else {
+		slice := s.endpointSlice(serviceName, namespace, "", port)
+		slice.IP = ips
+		slice.Hostnames = hostnames
+		slice.Pods = pods
+		err = s.kube.Tracker().Add(slice.AsK8S())
 	}
-	err := s.kube.Tracker().Add(endpoint.AsK8S()) //nolint:staticcheck // We use Endpoint to simulate legacy Kube compatibility
 	s.Require().NoError(err)
 }
 
+func (s *XdsIntegrationTestSuite) endpointSlice(serviceName string, namespace string, ip string, port int32) *test.K8SEndpointSlice {
+	return &test.K8SEndpointSlice{
+		Name:        serviceName + "-xds",
+		Namespace:   namespace,
+		ServiceName: serviceName,
+		IP:          []string{ip},
+		Ports: []discoveryv1.EndpointPort{{
+			Name: ptr.To("grpc"),
+			Port: ptr.To(port),
+		}},
+	}
+}
+
 func (s *XdsIntegrationTestSuite) getFakeServiceIP() string {
 	out := s.fakeServiceIP
 	s.fakeServiceIP += 1
@@ -160,35 +250,49 @@ func (s *XdsIntegrationTestSuite) TestValidTarget() {
 	s.createKubeEndpoint("app", "unused", "0.0.0.1", 1)
 
 	svc = s.createFakeService("app", "default", 0, false)
-	err := s.kube.Tracker().Update(
-		schema.GroupVersionResource{Group: "", Version: "v1", Resource: "endpoints"},
-		&corev1.Endpoints{ //nolint:staticcheck // We use Endpoint to simulate legacy Kube compatibility
-			TypeMeta: metav1.TypeMeta{
-				APIVersion: "v1",
-				Kind:       "Endpoints",
-			},
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      "app",
-				Namespace: "default",
-			},
-			Subsets: []corev1.EndpointSubset{{ //nolint:staticcheck // See above
-				Addresses: []corev1.EndpointAddress{{ //nolint:staticcheck // See above
-					IP: svc.Host(),
-				}},
-				Ports: []corev1.EndpointPort{ //nolint:staticcheck // See above
-					{
-						Name: "grpc",
-						Port: svc.Port(),
-					},
-					{
-						Name: "http",
-						Port: 9999,
-					},
+	var err error
+	if s.legacyEndpoints {
+		err = s.kube.Tracker().Update(
+			schema.GroupVersionResource{Group: "", Version: "v1", Resource: "endpoints"},
+			&corev1.Endpoints{ //nolint:staticcheck // We use Endpoint to simulate legacy Kube compatibility
+				TypeMeta: metav1.TypeMeta{
+					APIVersion: "v1",
+					Kind:       "Endpoints",
 				},
-			}},
-		},
-		"default",
-	)
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "app",
+					Namespace: "default",
+				},
+				Subsets: []corev1.EndpointSubset{{ //nolint:staticcheck // See above
+					Addresses: []corev1.EndpointAddress{{ //nolint:staticcheck // See above
+						IP: svc.Host(),
+					}},
+					Ports: []corev1.EndpointPort{ //nolint:staticcheck // See above
+						{
+							Name: "grpc",
+							Port: svc.Port(),
+						},
+						{
+							Name: "http",
+							Port: 9999,
+						},
+					},
+				}},
+			},
+			"default",
+		)
+	} else {
+		slice := s.endpointSlice("app", "default", svc.Host(), svc.Port())
+		slice.Ports = append(slice.Ports, discoveryv1.EndpointPort{
+			Name: ptr.To("http"),
+			Port: ptr.To[int32](9999),
+		})
+		err = s.kube.Tracker().Update(
+			schema.GroupVersionResource{Group: "discovery.k8s.io", Version: "v1", Resource: "endpointslices"},
+			slice.AsK8S(),
+			"default",
+		)
+	}
 	s.Require().NoError(err)
 
 	// It doesn't seems that XDS propagation works in test??
@@ -244,10 +348,630 @@ func (s *XdsIntegrationTestSuite) TestApiGateway() {
 	require.NoError(s.T(), err)
 }
 
+func (s *XdsIntegrationTestSuite) TestNodeGroup() {
+	svc := s.createFakeService("grouped", "default", 0, false)
+	svcManifest := &test.K8SService{
+		Name:      "grouped",
+		Namespace: "default",
+		Annotations: map[string]string{
+			snapshot.AnnotationVisibility: "frontend",
+		},
+		Ports: []corev1.ServicePort{{
+			Name:     "grpc",
+			Port:     1,
+			Protocol: corev1.ProtocolTCP,
+		}},
+	}
+	err := s.kube.Tracker().Add(svcManifest.AsK8S())
+	s.Require().NoError(err)
+	s.createKubeEndpoint("grouped", "default", svc.Host(), svc.Port())
+
+	svc.On("Check", mock.Anything, "test").Return(&grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil)
+
+	client := s.getClientWithMetadata("xds:///grouped.default:1", map[string]string{
+		snapshot.NodeMetadataNamespace: "frontend",
+	})
+	_, err = client.Check(s.T().Context(), &grpc_health_v1.HealthCheckRequest{Service: "test"})
+	s.Require().NoError(err)
+}
+
+func (s *XdsIntegrationTestSuite) TestLbPolicy() {
+	for _, lbPolicy := range []string{
+		snapshot.LbPolicyRoundRobin,
+		snapshot.LbPolicyLeastRequest + ",choice_count=3",
+		snapshot.LbPolicyPickFirst + ",shuffle_address_list=true",
+		snapshot.LbPolicyRingHash + ",min_ring_size=64,max_ring_size=1024",
+		snapshot.LbPolicyWeightedRoundRobin,
+	} {
+		s.Run(lbPolicy, func() {
+			name := "lb-" + strings.ReplaceAll(strings.SplitN(lbPolicy, ",", 2)[0], "_", "-")
+			client := s.createAnnotatedService(name, map[string]string{
+				snapshot.AnnotationLbPolicy: lbPolicy,
+			})
+			_, err := client.Check(s.T().Context(), &grpc_health_v1.HealthCheckRequest{Service: "test"})
+			s.Require().NoError(err)
+		})
+	}
+}
+
+func (s *XdsIntegrationTestSuite) TestOutlierDetection() {
+	client := s.createAnnotatedService("outlier", map[string]string{
+		snapshot.AnnotationOutlierSuccessRate:       "stdev_factor=1900,request_volume=10",
+		snapshot.AnnotationOutlierFailurePercentage: "threshold=50",
+		snapshot.AnnotationOutlierInterval:          "1s",
+	})
+	_, err := client.Check(s.T().Context(), &grpc_health_v1.HealthCheckRequest{Service: "test"})
+	s.Require().NoError(err)
+}
+
+func (s *XdsIntegrationTestSuite) TestFaultInjection() {
+	// Calls are aborted by the client, so the service expects none
+	_, client := s.createAnnotatedFakeService("fault", map[string]string{
+		snapshot.AnnotationFaultAbort: "resource-exhausted",
+	})
+	_, err := client.Check(s.T().Context(), &grpc_health_v1.HealthCheckRequest{Service: "test"})
+	s.Require().Equal(codes.ResourceExhausted, status.Code(err))
+}
+
+func (s *XdsIntegrationTestSuite) TestTimeout() {
+	svc, client := s.createAnnotatedFakeService("timeout", map[string]string{
+		snapshot.AnnotationTimeout: "50ms",
+	})
+	svc.On("Check", mock.Anything, "ready").Return(&grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil)
+	svc.On("Check", mock.Anything, "test").After(time.Second).Return(&grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil)
+
+	// Wait for the client to be ready, so that the timeout only cover the call
+	_, err := client.Check(s.T().Context(), &grpc_health_v1.HealthCheckRequest{Service: "ready"})
+	s.Require().NoError(err)
+
+	_, err = client.Check(s.T().Context(), &grpc_health_v1.HealthCheckRequest{Service: "test"})
+	s.Require().Equal(codes.DeadlineExceeded, status.Code(err))
+}
+
+func (s *XdsIntegrationTestSuite) TestMaxRequests() {
+	svc, client := s.createAnnotatedFakeService("maxrequests", map[string]string{
+		snapshot.AnnotationMaxRequests: "1",
+	})
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	svc.On("Check", mock.Anything, "ready").Return(&grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil)
+	svc.On("Check", mock.Anything, "slow").Run(func(mock.Arguments) {
+		close(started)
+		<-release
+	}).Return(&grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil)
+
+	_, err := client.Check(s.T().Context(), &grpc_health_v1.HealthCheckRequest{Service: "ready"})
+	s.Require().NoError(err)
+
+	slowErr := make(chan error)
+	go func() {
+		_, err := client.Check(s.T().Context(), &grpc_health_v1.HealthCheckRequest{Service: "slow"})
+		slowErr <- err
+	}()
+	<-started
+
+	// The slow call takes the only request slot, so this call is dropped by the client
+	_, err = client.Check(s.T().Context(), &grpc_health_v1.HealthCheckRequest{Service: "ready"})
+	s.Require().Equal(codes.Unavailable, status.Code(err))
+
+	close(release)
+	s.Require().NoError(<-slowErr)
+}
+
+func (s *XdsIntegrationTestSuite) TestMTLS() {
+	serverTLS, err := s.certificateAuthority.ServerTLSConfig("spiffe://cluster.local/ns/default/sa/mtls")
+	s.Require().NoError(err)
+	svc, err := test.NewFakeService(s.getFakeServiceIP()+":0", grpc.Creds(credentials.NewTLS(serverTLS)))
+	s.Require().NoError(err)
+	svc.Test(s.T())
+	s.activeFakeServices = append(s.activeFakeServices, svc)
+
+	// Both services point to the same server, but only the first expects its identity
+	serviceAccounts := map[string]string{
+		"mtls":          "mtls",
+		"mtls-mismatch": "other",
+	}
+	for name, serviceAccount := range serviceAccounts {
+		svcManifest := &test.K8SService{
+			Name:      name,
+			Namespace: "default",
+			Annotations: map[string]string{
+				snapshot.AnnotationMTLS:                "true",
+				snapshot.AnnotationMTLSServiceAccounts: serviceAccount,
+			},
+			Ports: []corev1.ServicePort{{
+				Name:     "grpc",
+				Port:     1,
+				Protocol: corev1.ProtocolTCP,
+			}},
+		}
+		err = s.kube.Tracker().Add(svcManifest.AsK8S())
+		s.Require().NoError(err)
+		s.createKubeEndpoint(name, "default", svc.Host(), svc.Port())
+	}
+
+	svc.On("Check", mock.Anything, "test").Return(&grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil)
+
+	client := s.getClient("xds:///mtls.default:1")
+	resp, err := client.Check(s.T().Context(), &grpc_health_v1.HealthCheckRequest{Service: "test"})
+	s.Require().NoError(err)
+	s.Require().Equal(grpc_health_v1.HealthCheckResponse_SERVING, resp.Status)
+
+	client = s.getClient("xds:///mtls-mismatch.default:1")
+	ctx, cancel := context.WithTimeout(s.T().Context(), time.Second)
+	defer cancel()
+	_, err = client.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: "test"})
+	s.Require().Error(err)
+}
+
+func (s *XdsIntegrationTestSuite) TestServerListener() {
+	svc := s.createXdsService("xdsserver", nil, insecure.NewCredentials())
+	svc.On("Check", mock.Anything, "test").Return(&grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil)
+
+	client := s.getClient("xds:///xdsserver.default:1")
+	resp, err := client.Check(s.T().Context(), &grpc_health_v1.HealthCheckRequest{Service: "test"})
+	s.Require().NoError(err)
+	s.Require().Equal(grpc_health_v1.HealthCheckResponse_SERVING, resp.Status)
+}
+
+func (s *XdsIntegrationTestSuite) TestServerListenerMTLS() {
+	creds, err := xdscreds.NewServerCredentials(xdscreds.ServerOptions{FallbackCreds: insecure.NewCredentials()})
+	s.Require().NoError(err)
+	svc := s.createXdsService("xdsserver-mtls", map[string]string{
+		snapshot.AnnotationMTLS: "true",
+	}, creds)
+	svc.On("Check", mock.Anything, "test").Return(&grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil)
+
+	client := s.getClient("xds:///xdsserver-mtls.default:1")
+	resp, err := client.Check(s.T().Context(), &grpc_health_v1.HealthCheckRequest{Service: "test"})
+	s.Require().NoError(err)
+	s.Require().Equal(grpc_health_v1.HealthCheckResponse_SERVING, resp.Status)
+
+	// Plaintext clients are rejected by the server
+	plaintext, err := grpc.NewClient(svc.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	s.Require().NoError(err)
+	defer plaintext.Close()
+	ctx, cancel := context.WithTimeout(s.T().Context(), time.Second)
+	defer cancel()
+	_, err = grpc_health_v1.NewHealthClient(plaintext).Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: "test"})
+	s.Require().Error(err)
+}
+
+func (s *XdsIntegrationTestSuite) TestRBAC() {
+	creds, err := xdscreds.NewServerCredentials(xdscreds.ServerOptions{FallbackCreds: insecure.NewCredentials()})
+	s.Require().NoError(err)
+
+	allowed := s.createXdsService("rbac-allowed", map[string]string{
+		snapshot.AnnotationMTLS:                 "true",
+		snapshot.AnnotationAllowServiceAccounts: "client",
+		snapshot.AnnotationAllowMethods:         "grpc.health.v1.Health/Check",
+	}, creds)
+	allowed.On("Check", mock.Anything, "test").Return(&grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil)
+	s.createXdsService("rbac-other-caller", map[string]string{
+		snapshot.AnnotationMTLS:                 "true",
+		snapshot.AnnotationAllowServiceAccounts: "other",
+	}, creds)
+	s.createXdsService("rbac-other-method", map[string]string{
+		snapshot.AnnotationAllowMethods: "grpc.health.v1.Health/Watch",
+	}, insecure.NewCredentials())
+
+	client := s.getClient("xds:///rbac-allowed.default:1")
+	resp, err := client.Check(s.T().Context(), &grpc_health_v1.HealthCheckRequest{Service: "test"})
+	s.Require().NoError(err)
+	s.Require().Equal(grpc_health_v1.HealthCheckResponse_SERVING, resp.Status)
+
+	client = s.getClient("xds:///rbac-other-caller.default:1")
+	_, err = client.Check(s.T().Context(), &grpc_health_v1.HealthCheckRequest{Service: "test"})
+	s.Require().Equal(codes.PermissionDenied, status.Code(err))
+
+	client = s.getClient("xds:///rbac-other-method.default:1")
+	_, err = client.Check(s.T().Context(), &grpc_health_v1.HealthCheckRequest{Service: "test"})
+	s.Require().Equal(codes.PermissionDenied, status.Code(err))
+}
+
+func (s *XdsIntegrationTestSuite) TestStatefulSession() {
+	// The filter is optional, so clients that do not support stateful session can still call the service
+	client := s.createAnnotatedService("statefulsession", map[string]string{
+		snapshot.AnnotationSessionCookie: "session,path=/,ttl=1h",
+	})
+	_, err := client.Check(s.T().Context(), &grpc_health_v1.HealthCheckRequest{Service: "test"})
+	s.Require().NoError(err)
+}
+
+func (s *XdsIntegrationTestSuite) TestSessionAffinity() {
+	backends := []*test.FakeService{
+		s.createFakeService("affinity", "default", 50010, false),
+		s.createFakeService("affinity", "default", 50010, false),
+	}
+	svcManifest := &test.K8SService{
+		Name:            "affinity",
+		Namespace:       "default",
+		SessionAffinity: corev1.ServiceAffinityClientIP,
+		Ports: []corev1.ServicePort{{
+			Name:     "grpc",
+			Port:     1,
+			Protocol: corev1.ProtocolTCP,
+		}},
+	}
+	err := s.kube.Tracker().Add(svcManifest.AsK8S())
+	s.Require().NoError(err)
+	s.createKubeEndpoints("affinity", "default", []string{backends[0].Host(), backends[1].Host()}, 50010)
+
+	for _, backend := range backends {
+		backend.On("Check", mock.Anything, "test").Return(&grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil).Maybe()
+	}
+
+	client := s.getClient("xds:///affinity.default:1")
+	for range 20 {
+		_, err = client.Check(s.T().Context(), &grpc_health_v1.HealthCheckRequest{Service: "test"})
+		s.Require().NoError(err)
+	}
+
+	// Every call of the channel goes to the same backend
+	calls := []int{len(backends[0].Calls), len(backends[1].Calls)}
+	s.Require().ElementsMatch([]int{0, 20}, calls)
+}
+
+func (s *XdsIntegrationTestSuite) TestHashHeader() {
+	backends := []*test.FakeService{
+		s.createFakeService("hash-header", "default", 50011, false),
+		s.createFakeService("hash-header", "default", 50011, false),
+	}
+	svcManifest := &test.K8SService{
+		Name:      "hash-header",
+		Namespace: "default",
+		Annotations: map[string]string{
+			snapshot.AnnotationHashHeader: "x-user-id",
+		},
+		Ports: []corev1.ServicePort{{
+			Name:     "grpc",
+			Port:     1,
+			Protocol: corev1.ProtocolTCP,
+		}},
+	}
+	err := s.kube.Tracker().Add(svcManifest.AsK8S())
+	s.Require().NoError(err)
+	s.createKubeEndpoints("hash-header", "default", []string{backends[0].Host(), backends[1].Host()}, 50011)
+
+	for _, backend := range backends {
+		backend.On("Check", mock.Anything, "test").Return(&grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil).Maybe()
+	}
+
+	// Calls with the same header go to the same backend regardless of the channel
+	ctx := metadata.AppendToOutgoingContext(s.T().Context(), "x-user-id", "alice")
+	for range 4 {
+		client := s.getClient("xds:///hash-header.default:1")
+		for range 5 {
+			_, err = client.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: "test"})
+			s.Require().NoError(err)
+		}
+	}
+
+	calls := []int{len(backends[0].Calls), len(backends[1].Calls)}
+	s.Require().ElementsMatch([]int{0, 20}, calls)
+}
+
+func (s *XdsIntegrationTestSuite) TestFailover() {
+	s.createAnnotatedService("failover-fallback", nil)
+
+	// Nothing listens on the primary's endpoint, so calls only succeed if they fail over
+	svcManifest := &test.K8SService{
+		Name:      "failover",
+		Namespace: "default",
+		Annotations: map[string]string{
+			snapshot.AnnotationFailover: "failover-fallback",
+		},
+		Ports: []corev1.ServicePort{{
+			Name:     "grpc",
+			Port:     1,
+			Protocol: corev1.ProtocolTCP,
+		}},
+	}
+	err := s.kube.Tracker().Add(svcManifest.AsK8S())
+	s.Require().NoError(err)
+	s.createKubeEndpoint("failover", "default", s.getFakeServiceIP(), 50012)
+
+	client := s.getClient("xds:///failover.default:1")
+	for range 10 {
+		resp, err := client.Check(s.T().Context(), &grpc_health_v1.HealthCheckRequest{Service: "test"}, grpc.WaitForReady(true))
+		s.Require().NoError(err)
+		s.Require().Equal(grpc_health_v1.HealthCheckResponse_SERVING, resp.Status)
+	}
+}
+
+func (s *XdsIntegrationTestSuite) TestExternalName() {
+	svc := s.createFakeService("external", "default", 50013, false)
+	svc.On("Check", mock.Anything, "test").Return(&grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil)
+
+	// The service has no endpoints, so calls only succeed if they go to the external name
+	svcManifest := &test.K8SService{
+		Name:         "external",
+		Namespace:    "default",
+		Type:         corev1.ServiceTypeExternalName,
+		ExternalName: svc.Host(),
+		Ports: []corev1.ServicePort{{
+			Name:     "grpc",
+			Port:     50013,
+			Protocol: corev1.ProtocolTCP,
+		}},
+	}
+	err := s.kube.Tracker().Add(svcManifest.AsK8S())
+	s.Require().NoError(err)
+
+	client := s.getClient("xds:///external.default:50013")
+	resp, err := client.Check(s.T().Context(), &grpc_health_v1.HealthCheckRequest{Service: "test"})
+	s.Require().NoError(err)
+	s.Require().Equal(grpc_health_v1.HealthCheckResponse_SERVING, resp.Status)
+}
+
+func (s *XdsIntegrationTestSuite) TestAddressModeClusterIP() {
+	svc := s.createFakeService("cluster-ip", "default", 0, false)
+	svc.On("Check", mock.Anything, "test").Return(&grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil)
+
+	// Nothing listens on the pod's address, so calls only succeed if they go to the ClusterIP
+	svcManifest := &test.K8SService{
+		Name:      "cluster-ip",
+		Namespace: "default",
+		ClusterIP: svc.Host(),
+		Annotations: map[string]string{
+			snapshot.AnnotationAddressMode: snapshot.AddressModeClusterIP,
+		},
+		Ports: []corev1.ServicePort{{
+			Name:     "grpc",
+			Port:     svc.Port(),
+			Protocol: corev1.ProtocolTCP,
+		}},
+	}
+	err := s.kube.Tracker().Add(svcManifest.AsK8S())
+	s.Require().NoError(err)
+	s.createKubeEndpoint("cluster-ip", "default", s.getFakeServiceIP(), 50014)
+
+	client := s.getClient(fmt.Sprintf("xds:///cluster-ip.default:%d", svc.Port()))
+	resp, err := client.Check(s.T().Context(), &grpc_health_v1.HealthCheckRequest{Service: "test"})
+	s.Require().NoError(err)
+	s.Require().Equal(grpc_health_v1.HealthCheckResponse_SERVING, resp.Status)
+}
+
+func (s *XdsIntegrationTestSuite) TestPodService() {
+	backends := []*test.FakeService{
+		s.createFakeService("db", "default", 50015, false),
+		s.createFakeService("db", "default", 50015, false),
+	}
+	svcManifest := &test.K8SService{
+		Name:      "db",
+		Namespace: "default",
+		ClusterIP: corev1.ClusterIPNone,
+		Ports: []corev1.ServicePort{{
+			Name:     "grpc",
+			Port:     1,
+			Protocol: corev1.ProtocolTCP,
+		}},
+	}
+	err := s.kube.Tracker().Add(svcManifest.AsK8S())
+	s.Require().NoError(err)
+	s.createKubePodEndpoints("db", "default", []string{backends[0].Host(), backends[1].Host()}, nil, []string{"db-0", "db-1"}, 50015)
+
+	backends[1].On("Check", mock.Anything, "test").Return(&grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil).Times(10)
+
+	// Every call goes to the named pod only
+	client := s.getClient("xds:///db-1.db.default:1")
+	for range 10 {
+		resp, err := client.Check(s.T().Context(), &grpc_health_v1.HealthCheckRequest{Service: "test"})
+		s.Require().NoError(err)
+		s.Require().Equal(grpc_health_v1.HealthCheckResponse_SERVING, resp.Status)
+	}
+}
+
+func (s *XdsIntegrationTestSuite) TestMultipleAddresses() {
+	// pod-a listens on two addresses, as a pod on dual-stack clusters
+	backends := []*test.FakeService{
+		s.createFakeService("multi-address", "default", 50016, false),
+		s.createFakeService("multi-address", "default", 50016, false),
+		s.createFakeService("multi-address", "default", 50016, false),
+	}
+	s.createKubeService("multi-address", "default", 1)
+	s.createKubePodEndpoints("multi-address", "default",
+		[]string{backends[0].Host(), backends[1].Host(), backends[2].Host()},
+		[]string{"pod-a", "pod-a", "pod-b"},
+		nil, 50016)
+
+	for _, backend := range backends {
+		backend.On("Check", mock.Anything, "test").Return(&grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil).Maybe()
+	}
+
+	podACalls := func() int {
+		return len(backends[0].Calls) + len(backends[1].Calls)
+	}
+	podBCalls := func() int {
+		return len(backends[2].Calls)
+	}
+
+	// Calls only go to connected pods, so wait until both are connected
+	client := s.getClient("xds:///multi-address.default:1")
+	s.Require().Eventually(func() bool {
+		_, err := client.Check(s.T().Context(), &grpc_health_v1.HealthCheckRequest{Service: "test"})
+		s.Require().NoError(err)
+		return podACalls() > 0 && podBCalls() > 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	podA, podB := podACalls(), podBCalls()
+	for range 20 {
+		_, err := client.Check(s.T().Context(), &grpc_health_v1.HealthCheckRequest{Service: "test"})
+		s.Require().NoError(err)
+	}
+
+	// Each pod gets an equal share of calls regardless of its number of addresses
+	s.Require().Equal(10, podACalls()-podA)
+	s.Require().Equal(10, podBCalls()-podB)
+}
+
+func (s *XdsIntegrationTestSuite) TestTrafficSplit() {
+	s.createAnnotatedService("split-v2", nil)
+
+	// The split service has no endpoints, so calls only succeed if they are routed to split-v2
+	svcManifest := &test.K8SService{
+		Name:      "split",
+		Namespace: "default",
+		Annotations: map[string]string{
+			snapshot.AnnotationTrafficSplit: "split-v2=100,split=0",
+		},
+		Ports: []corev1.ServicePort{{
+			Name:     "grpc",
+			Port:     1,
+			Protocol: corev1.ProtocolTCP,
+		}},
+	}
+	err := s.kube.Tracker().Add(svcManifest.AsK8S())
+	s.Require().NoError(err)
+
+	client := s.getClient("xds:///split.default:1")
+	for range 10 {
+		resp, err := client.Check(s.T().Context(), &grpc_health_v1.HealthCheckRequest{Service: "test"})
+		s.Require().NoError(err)
+		s.Require().Equal(grpc_health_v1.HealthCheckResponse_SERVING, resp.Status)
+	}
+}
+
+func (s *XdsIntegrationTestSuite) TestHeaderRoutes() {
+	s.createAnnotatedService("headerroute-canary", nil)
+
+	// The headerroute service has no endpoints, so calls only succeed if they are routed to headerroute-canary
+	svcManifest := &test.K8SService{
+		Name:      "headerroute",
+		Namespace: "default",
+		Annotations: map[string]string{
+			snapshot.AnnotationHeaderRoutes: "x-canary=true->headerroute-canary",
+		},
+		Ports: []corev1.ServicePort{{
+			Name:     "grpc",
+			Port:     1,
+			Protocol: corev1.ProtocolTCP,
+		}},
+	}
+	err := s.kube.Tracker().Add(svcManifest.AsK8S())
+	s.Require().NoError(err)
+
+	client := s.getClient("xds:///headerroute.default:1")
+	ctx := metadata.AppendToOutgoingContext(s.T().Context(), "x-canary", "true")
+	resp, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: "test"})
+	s.Require().NoError(err)
+	s.Require().Equal(grpc_health_v1.HealthCheckResponse_SERVING, resp.Status)
+
+	ctx, cancel := context.WithTimeout(s.T().Context(), 100*time.Millisecond)
+	defer cancel()
+	_, err = client.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: "test"})
+	s.Require().Error(err)
+}
+
+// createXdsService register a fake gRPC xDS server with the annotations in the default namespace,
+// and wait until it receive its Listener
+func (s *XdsIntegrationTestSuite) createXdsService(name string, annotations map[string]string, creds credentials.TransportCredentials) *test.FakeService {
+	serving := make(chan struct{})
+	var once sync.Once
+	svc, err := test.NewFakeXdsService(s.getFakeServiceIP()+":0",
+		grpc.Creds(creds),
+		xds.BootstrapContentsForTesting(s.bootstrap(nil)),
+		xds.ServingModeCallback(func(addr net.Addr, args xds.ServingModeChangeArgs) {
+			if args.Mode == connectivity.ServingModeServing {
+				once.Do(func() {
+					close(serving)
+				})
+			}
+		}),
+	)
+	s.Require().NoError(err)
+	svc.Test(s.T())
+	s.activeFakeServices = append(s.activeFakeServices, svc)
+
+	svcManifest := &test.K8SService{
+		Name:        name,
+		Namespace:   "default",
+		Annotations: annotations,
+		Ports: []corev1.ServicePort{{
+			Name:     "grpc",
+			Port:     1,
+			Protocol: corev1.ProtocolTCP,
+		}},
+	}
+	err = s.kube.Tracker().Add(svcManifest.AsK8S())
+	s.Require().NoError(err)
+	s.createKubeEndpoint(name, "default", svc.Host(), svc.Port())
+
+	select {
+	case <-serving:
+	case <-time.After(5 * time.Second):
+		s.FailNow("xDS server did not start serving")
+	}
+
+	return svc
+}
+
+// createAnnotatedService register a serving fake service with the annotations in the default namespace
+// and return a client of its port 1
+func (s *XdsIntegrationTestSuite) createAnnotatedService(name string, annotations map[string]string) grpc_health_v1.HealthClient {
+	svc, client := s.createAnnotatedFakeService(name, annotations)
+	svc.On("Check", mock.Anything, "test").Return(&grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil)
+	return client
+}
+
+// createAnnotatedFakeService is createAnnotatedService without mocks, for tests that set their own
+func (s *XdsIntegrationTestSuite) createAnnotatedFakeService(name string, annotations map[string]string) (*test.FakeService, grpc_health_v1.HealthClient) {
+	svc := s.createFakeService(name, "default", 0, false)
+	svcManifest := &test.K8SService{
+		Name:        name,
+		Namespace:   "default",
+		Annotations: annotations,
+		Ports: []corev1.ServicePort{{
+			Name:     "grpc",
+			Port:     1,
+			Protocol: corev1.ProtocolTCP,
+		}},
+	}
+	err := s.kube.Tracker().Add(svcManifest.AsK8S())
+	s.Require().NoError(err)
+	s.createKubeEndpoint(name, "default", svc.Host(), svc.Port())
+
+	return svc, s.getClient(fmt.Sprintf("xds:///%s.default:1", name))
+}
+
 func TestXdsIntegration(t *testing.T) {
 	kube := fake.NewClientset()
 
-	testServer, stop, err := di.InitializeTestServer(t.Context(), kube, 1)
+	testServer, stop, err := di.InitializeTestServer(t.Context(), kube, 1, nil)
+	require.NoError(t, err)
+	defer stop()
+
+	suite.Run(t, &XdsIntegrationTestSuite{
+		TestServer: testServer,
+		kube:       kube,
+	})
+}
+
+func TestXdsIntegrationLegacyEndpoints(t *testing.T) {
+	kube := fake.NewClientset()
+
+	testServer, stop, err := di.InitializeTestServer(t.Context(), kube, 1, di.SnapshotterOptions{
+		snapshot.WithLegacyEndpoints(true),
+	})
+	require.NoError(t, err)
+	defer stop()
+
+	suite.Run(t, &XdsIntegrationTestSuite{
+		TestServer:      testServer,
+		kube:            kube,
+		legacyEndpoints: true,
+	})
+}
+
+func TestXdsIntegrationScoped(t *testing.T) {
+	kube := fake.NewClientset()
+
+	testServer, stop, err := di.InitializeTestServer(t.Context(), kube, 1, di.SnapshotterOptions{
+		snapshot.WithScope(snapshot.Scope{
+			Namespaces: []string{"default", "unused"},
+		}),
+	})
 	require.NoError(t, err)
 	defer stop()
 
@@ -2,14 +2,19 @@ package test
 
 import (
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 type K8SService struct {
-	Name        string
-	Namespace   string
-	Ports       []corev1.ServicePort
-	Annotations map[string]string
+	Name            string
+	Namespace       string
+	Ports           []corev1.ServicePort
+	Annotations     map[string]string
+	SessionAffinity corev1.ServiceAffinity
+	Type            corev1.ServiceType
+	ExternalName    string
+	ClusterIP       string
 }
 
 func (k *K8SService) AsK8S() *corev1.Service {
@@ -21,7 +26,11 @@ func (k *K8SService) AsK8S() *corev1.Service {
 			Annotations: k.Annotations,
 		},
 		Spec: corev1.ServiceSpec{
-			Ports: k.Ports,
+			Ports:           k.Ports,
+			SessionAffinity: k.SessionAffinity,
+			Type:            k.Type,
+			ExternalName:    k.ExternalName,
+			ClusterIP:       k.ClusterIP,
 		},
 	}
 }
@@ -30,13 +39,23 @@ type K8SEndpoint struct {
 	Name      string
 	Namespace string
 	IP        []string
-	Ports     []corev1.EndpointPort //nolint:staticcheck // We use Endpoint to simulate legacy Kube compatibility
+	// Hostnames of the IPs at the same index, if any
+	Hostnames []string
+	// Pods of the IPs at the same index, if any
+	Pods  []string
+	Ports []corev1.EndpointPort //nolint:staticcheck // We use Endpoint to simulate legacy Kube compatibility
 }
 
 func (k *K8SEndpoint) AsK8S() *corev1.Endpoints { //nolint:staticcheck // We use Endpoint to simulate legacy Kube compatibility
 	addresses := make([]corev1.EndpointAddress, len(k.IP)) //nolint:staticcheck // See above
 	for i, ip := range k.IP {
 		addresses[i] = corev1.EndpointAddress{IP: ip} //nolint:staticcheck // See above
+		if i < len(k.Hostnames) {
+			addresses[i].Hostname = k.Hostnames[i]
+		}
+		if i < len(k.Pods) {
+			addresses[i].TargetRef = &corev1.ObjectReference{Kind: "Pod", Namespace: k.Namespace, Name: k.Pods[i]}
+		}
 	}
 	return &corev1.Endpoints{ //nolint:staticcheck // See above
 		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Endpoints"},
@@ -50,3 +69,41 @@ func (k *K8SEndpoint) AsK8S() *corev1.Endpoints { //nolint:staticcheck // We use
 		}},
 	}
 }
+
+type K8SEndpointSlice struct {
+	Name        string
+	Namespace   string
+	ServiceName string
+	IP          []string
+	// Hostnames of the IPs at the same index, if any
+	Hostnames []string
+	// Pods of the IPs at the same index, if any
+	Pods  []string
+	Ports []discoveryv1.EndpointPort
+}
+
+func (k *K8SEndpointSlice) AsK8S() *discoveryv1.EndpointSlice {
+	endpoints := make([]discoveryv1.Endpoint, len(k.IP))
+	for i, ip := range k.IP {
+		endpoints[i] = discoveryv1.Endpoint{Addresses: []string{ip}}
+		if i < len(k.Hostnames) {
+			endpoints[i].Hostname = &k.Hostnames[i]
+		}
+		if i < len(k.Pods) {
+			endpoints[i].TargetRef = &corev1.ObjectReference{Kind: "Pod", Namespace: k.Namespace, Name: k.Pods[i]}
+		}
+	}
+	return &discoveryv1.EndpointSlice{
+		TypeMeta: metav1.TypeMeta{APIVersion: "discovery.k8s.io/v1", Kind: "EndpointSlice"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      k.Name,
+			Namespace: k.Namespace,
+			Labels: map[string]string{
+				discoveryv1.LabelServiceName: k.ServiceName,
+			},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints:   endpoints,
+		Ports:       k.Ports,
+	}
+}
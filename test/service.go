@@ -8,17 +8,36 @@ import (
 	"github.com/stretchr/testify/mock"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/xds"
 )
 
 type FakeService struct {
 	mock.Mock
 
 	listener   net.Listener
-	grpcServer *grpc.Server
+	grpcServer grpcServer
 }
 
-func NewFakeService(addr string) (*FakeService, error) {
-	server := grpc.NewServer()
+type grpcServer interface {
+	grpc.ServiceRegistrar
+	Serve(net.Listener) error
+	Stop()
+}
+
+func NewFakeService(addr string, opts ...grpc.ServerOption) (*FakeService, error) {
+	return newFakeService(addr, grpc.NewServer(opts...))
+}
+
+// NewFakeXdsService start a fake service as a gRPC xDS server, which only serve once it receive its Listener
+func NewFakeXdsService(addr string, opts ...grpc.ServerOption) (*FakeService, error) {
+	server, err := xds.NewGRPCServer(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return newFakeService(addr, server)
+}
+
+func newFakeService(addr string, server grpcServer) (*FakeService, error) {
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return nil, err
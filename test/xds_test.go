@@ -14,7 +14,9 @@ import (
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/test/bufconn"
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
 )
 
 type XdsSuite struct {
@@ -30,7 +32,7 @@ func (s *XdsSuite) SetupTest() {
 	var err error
 	s.kube = fake.NewClientset()
 	s.conn = bufconn.Listen(1)
-	s.TestServer, s.stop, err = di.InitializeTestServer(s.T().Context(), s.kube, 1)
+	s.TestServer, s.stop, err = di.InitializeTestServer(s.T().Context(), s.kube, 1, nil)
 	s.Require().NoError(err)
 
 	go s.TestServer.GrpcServer.Serve(s.conn)
@@ -66,13 +68,14 @@ func (s *XdsSuite) TestEndpointInfo() {
 	}
 	s.kube.Tracker().Add(fakeSvc.AsK8S())
 
-	fakeEndpoint := &test.K8SEndpoint{
-		Name:      svcName,
-		Namespace: svcNamespace,
-		IP:        []string{"127.0.0.1"},
-		Ports: []corev1.EndpointPort{{
-			Name: "grpc",
-			Port: 50000,
+	fakeEndpoint := &test.K8SEndpointSlice{
+		Name:        svcName,
+		Namespace:   svcNamespace,
+		ServiceName: svcName,
+		IP:          []string{"127.0.0.1"},
+		Ports: []discoveryv1.EndpointPort{{
+			Name: ptr.To("grpc"),
+			Port: ptr.To[int32](50000),
 		}},
 	}
 	s.kube.Tracker().Add(fakeEndpoint.AsK8S())